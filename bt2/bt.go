@@ -56,47 +56,175 @@ type node struct {
 }
 
 type btreeCursor struct {
-	bpm            *buff.BufferPool
+	bpm            buff.Pool
 	_header        *headerPage
 	headerPageLock *sync.RWMutex
+	// false if bpm was given by WithBufferPool
+	ownsPool bool
+
+	deleteMu *sync.Mutex
+	// pages that could not be deleted yet because a reader still had them pinned
+	pendingDeletes []nodeID
+}
+
+const defaultPoolSize = 30
+
+// Option customizes the buffer pool of a tree created by NewBtree or NewBtreeOnDisk
+type Option func(*treeConfig)
+
+type treeConfig struct {
+	poolSize int
+	pool     buff.Pool
+	nodeSize int64
+}
+
+// WithPoolSize sets the number of frames of the buffer pool created for the tree
+func WithPoolSize(size int) Option {
+	return func(c *treeConfig) {
+		c.poolSize = size
+	}
+}
+
+// WithBufferPool stores the tree through bpm instead of a pool of its own, e.g. to Resize
+// the pool while the tree is in use or to spread a busy tree over a ParallelBufferPool.
+// The tree lives on the disk of bpm, so the constructors must be given no file or disk.
+// The caller keeps ownership of bpm, Close of the tree syncs it but does not close it
+func WithBufferPool(bpm buff.Pool) Option {
+	return func(c *treeConfig) {
+		c.pool = bpm
+	}
+}
+
+// WithNodeSize sets the node size of a tree created by Open, by default nodes fill a page.
+// A tree keeps the node size it was created with
+func WithNodeSize(size int64) Option {
+	return func(c *treeConfig) {
+		c.nodeSize = size
+	}
+}
+
+func newTreeConfig(opts []Option) treeConfig {
+	c := treeConfig{poolSize: defaultPoolSize}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// NewBtree opens or creates a tree stored in the file at filepath,
+// filepath must be empty if the tree is opened WithBufferPool
+func NewBtree(filepath string, nsize int64, opts ...Option) (*btreeCursor, error) {
+	if cfg := newTreeConfig(opts); cfg.pool != nil {
+		if filepath != "" {
+			return nil, fmt.Errorf("tree on an existing buffer pool cannot be stored in %s", filepath)
+		}
+		return openBtree(cfg.pool, nsize, false)
+	}
+	disk, err := buff.NewDiskManager(filepath)
+	if err != nil {
+		return nil, err
+	}
+	tr, err := NewBtreeOnDisk(disk, nsize, opts...)
+	if err != nil {
+		disk.Close()
+		return nil, err
+	}
+	return tr, nil
+}
+
+// NewBtreeOnDisk opens or creates a tree on any storage backend, the largest node size
+// depends on the page size of disk. The tree owns disk afterwards and closes it in Close.
+// disk must be nil if the tree is opened WithBufferPool
+func NewBtreeOnDisk(disk buff.DiskManager, nsize int64, opts ...Option) (*btreeCursor, error) {
+	cfg := newTreeConfig(opts)
+	if cfg.pool != nil {
+		if disk != nil {
+			return nil, fmt.Errorf("tree on an existing buffer pool cannot be given a disk")
+		}
+		return openBtree(cfg.pool, nsize, false)
+	}
+	if cfg.poolSize < 1 {
+		return nil, fmt.Errorf("pool size must be at least 1, got %d", cfg.poolSize)
+	}
+	return openBtree(buff.NewBufferPool(cfg.poolSize, disk), nsize, true)
 }
 
-func NewBtree(filepath string, nsize int64) *btreeCursor {
-	disk := buff.NewDiskManager(filepath)
-	bpm := buff.NewBufferPool(30, disk)
+// the smallest node size that can be split into two nodes
+const minNodeSize = 3
+
+// openBtree creates a tree with node size nsize if bpm holds none yet,
+// 0 picks the largest node size that fits in a page
+func openBtree(bpm buff.Pool, nsize int64, ownsPool bool) (*btreeCursor, error) {
+	limit := maxNodeSize(bpm.PageDataSize())
+	if nsize == 0 {
+		nsize = limit
+	}
+	if nsize > limit {
+		return nil, fmt.Errorf("node size %d does not fit in a page of %d bytes, at most %d", nsize, bpm.PageSize(), limit)
+	}
+	if nsize < minNodeSize {
+		return nil, fmt.Errorf("node size %d is less than %d", nsize, minNodeSize)
+	}
 	header, err := bpm.FetchPage(0)
 	if err != nil {
-		if errors.Is(err, io.EOF) {
-			header = bpm.NewPage()
-			if header == nil {
-				panic("either fetch page(0) or new page failed")
-			}
-			if header.GetPageID() != 0 {
-				panic("page id of first new page call is not 0")
-			}
-		} else {
-			panic(err)
+		if !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		header, err = bpm.NewPage()
+		if err != nil {
+			return nil, fmt.Errorf("either fetch page(0) or new page failed: %w", err)
+		}
+		if header.GetPageID() != 0 {
+			return nil, fmt.Errorf("page id of first new page call is not 0")
 		}
 	}
 	h := castHeaderPage(header.GetData())
+	if h.flags&headerFlagInit != 0 && h.flags&headerFlagLeafPrev == 0 {
+		bpm.UnpinPage(0, false)
+		return nil, fmt.Errorf("tree was created with an older node layout")
+	}
 	if h.flags&headerFlagInit == 0 {
-		h.flags ^= headerFlagInit
+		h.flags |= headerFlagInit | headerFlagLeafPrev
 		h.nodeSize = nsize
-		rootpage := bpm.NewPage()
-		if rootpage == nil {
-			panic("cannot create root page")
+		rootpage, err := bpm.NewPage()
+		if err != nil {
+			return nil, fmt.Errorf("cannot create root page: %w", err)
 		}
 		castLeafFromEmpty(int(h.nodeSize), rootpage)
 		h.rootPgid = nodeID(rootpage.GetPageID())
-		bpm.FlushPage(0)
-		bpm.FlushPage(int(h.rootPgid))
+		if err := bpm.FlushPage(0); err != nil {
+			return nil, err
+		}
+		if err := bpm.FlushPage(int(h.rootPgid)); err != nil {
+			return nil, err
+		}
 		bpm.UnpinPage(int(h.rootPgid), false)
 	}
 	return &btreeCursor{
 		bpm:            bpm,
 		_header:        h,
 		headerPageLock: header.GetLock(),
+		ownsPool:       ownsPool,
+		deleteMu:       &sync.Mutex{},
+	}, nil
+}
+
+// Sync makes every change done so far durable, it is meant to be called at commit points
+func (t *btreeCursor) Sync() error {
+	return t.bpm.Sync()
+}
+
+// Close releases the header page and flushes every page of the tree to disk,
+// the buffer pool is closed unless it was given by WithBufferPool
+func (t *btreeCursor) Close() error {
+	if pending := t.deletePages(nil); len(pending) > 0 {
+		return fmt.Errorf("delete page %d failed", pending[0])
+	}
+	t.bpm.UnpinPage(0, true)
+	if !t.ownsPool {
+		return t.bpm.Sync()
 	}
+	return t.bpm.Close()
 }
 
 func _leafNodeRemove(n *genericNode, idx int) {
@@ -104,26 +232,202 @@ func _leafNodeRemove(n *genericNode, idx int) {
 	n.datas[n.size-1] = valT{}
 	n.size--
 }
-func (t *tx) addFlush(pageID nodeID) {
-	t.tobeFlushed = append(t.tobeFlushed, pageID)
+// headerChanged records that tx has modified the header page
+func (t *tx) headerChanged() {
+	t.headerDirty = true
 }
 func (t *tx) addUnpin(pageID nodeID) {
 	t.tobeCleaned = append(t.tobeCleaned, pageID)
 }
-func (t *tx) unpinPages(bpm *buff.BufferPool) {
+
+// addLatched records a write latched node to be unlatched and unpinned when tx is released
+func (t *tx) addLatched(n *genericNode) {
+	t.latched = append(t.latched, n)
+	t.addUnpin(nodeID(n.osPage.GetPageID()))
+}
+
+// findLatched returns the node pageID if tx has write latched it off its path
+func (t *tx) findLatched(pageID nodeID) *genericNode {
+	for _, n := range t.latched {
+		if nodeID(n.osPage.GetPageID()) == pageID {
+			return n
+		}
+	}
+	return nil
+}
+func (t *tx) addDelete(pageID nodeID) {
+	t.tobeDeleted = append(t.tobeDeleted, pageID)
+}
+
+// release gives back every latch and every page this tx has pinned, including the
+// breadcrumbs that were never popped, then deletes the pages it has collected.
+// Pages are deleted last, along with the one pin this tx keeps on each of them.
+// Pins are always given back, even if deleting fails
+func (t *tx) release(c *btreeCursor) error {
+	for len(t.breadCrumbs) > 0 {
+		t.popNext()
+	}
+	t.unlatch(false)
+	t.unpinPages(c.bpm)
+	if t.headerDirty {
+		// the header page stays pinned by the cursor, an extra pin given back as dirty leaves
+		// it for Sync and Close to write like any other modified page, so that a failed write
+		// is not reported as the failure of an operation that has been applied
+		if _, err := c.bpm.FetchPage(0); err != nil {
+			c.deletePages(t.tobeDeleted)
+			return fmt.Errorf("failed to mark the header page dirty: %w", err)
+		}
+		c.bpm.UnpinPage(0, true)
+	}
+	c.deletePages(t.tobeDeleted)
+	return nil
+}
+
+// releaseInto releases tx and reports the error through err unless an earlier error is set,
+// it is meant to be deferred
+func (t *tx) releaseInto(c *btreeCursor, err *error) {
+	if releaseErr := t.release(c); *err == nil {
+		*err = releaseErr
+	}
+}
+
+// unlatch gives back the write latches of the popped and off path nodes and the header latch,
+// the pages stay pinned until tx is released. With leavesOnly the branches stay latched
+func (t *tx) unlatch(leavesOnly bool) {
+	kept := t.latched[:0]
+	for _, n := range t.latched {
+		if leavesOnly && !n.isLeafNode {
+			kept = append(kept, n)
+			continue
+		}
+		n.mu.Unlock()
+	}
+	t.latched = kept
+	if !leavesOnly && t.header != nil {
+		t.header.Unlock()
+		t.header = nil
+	}
+}
+
+// releaseAncestors unlatches and unpins every breadcrumb but the last one and the header,
+// none of them is modified once the last one is known to be safe
+func (t *tx) releaseAncestors(c *btreeCursor) {
+	if t.header != nil {
+		t.header.Unlock()
+		t.header = nil
+	}
+	last := len(t.breadCrumbs) - 1
+	for _, crumb := range t.breadCrumbs[:last] {
+		crumb.node.mu.Unlock()
+		c.bpm.UnpinPage(crumb.node.osPage.GetPageID(), false)
+	}
+	t.breadCrumbs = append(t.breadCrumbs[:0], t.breadCrumbs[last])
+}
+
+// deletePages gives back the pin the caller holds on each of pages and deletes them, along
+// with the deletions earlier calls left behind, it returns the pages left. A page is only
+// deleted once no one has it pinned, a reader stepping back along the leaf chain may briefly
+// pin a leaf that has just been merged away. Such a page is deleted by a later tx or by Close
+func (t *btreeCursor) deletePages(pages []nodeID) []nodeID {
+	t.deleteMu.Lock()
+	defer t.deleteMu.Unlock()
+	for _, pageID := range pages {
+		// dirty so that an eviction before the deletion keeps the node marked as deleted
+		t.bpm.UnpinPage(int(pageID), true)
+	}
+	var left []nodeID
+	for _, pageID := range append(t.pendingDeletes, pages...) {
+		if !t.bpm.DeletePage(int(pageID)) {
+			// either some other thread is using this deleted page or deallocation failed
+			left = append(left, pageID)
+		}
+	}
+	t.pendingDeletes = left
+	return left
+}
+
+// unpinPages gives back the pins of this tx but the ones on the pages to be deleted,
+// which are given back by deleting them
+func (t *tx) unpinPages(bpm buff.Pool) {
+	deleted := map[nodeID]int{}
+	for _, pageID := range t.tobeDeleted {
+		deleted[pageID]++
+	}
 	for _, pageID := range t.tobeCleaned {
+		if deleted[pageID] > 0 {
+			deleted[pageID]--
+			continue
+		}
 		bpm.UnpinPage(int(pageID), true)
 	}
+	for _, pageID := range t.pinned {
+		bpm.UnpinPage(int(pageID), false)
+	}
 }
 
-func (t *btreeCursor) delete(key keyT) error {
+// get returns the value stored with key, every page it touched is unpinned when it returns
+func (t *btreeCursor) get(key keyT) (int64, error) {
+	n, err := t.searchLeafRead(key)
+	if err != nil {
+		return 0, err
+	}
+	defer t.releaseRead(n)
+	idx, exact := t.leafNodeFindKeySlot(n, key)
+	if !exact {
+		return 0, fmt.Errorf("key %v: %w", key, ErrNotFound)
+	}
+	return n.datas[idx].val.main, nil
+}
+
+// searchLeafRead returns the leaf that holds key, pinned and read latched. It descends
+// from the root with read latches, the latch of a child is taken before the one of its
+// parent is released, so that a node is never visited while it is being modified.
+// Only one node stays pinned at a time
+func (t *btreeCursor) searchLeafRead(key keyT) (*genericNode, error) {
+	t.headerPageLock.RLock()
+	n, err := t.getRootNode()
+	if err != nil {
+		t.headerPageLock.RUnlock()
+		return nil, fmt.Errorf("failed to get root node: %w", err)
+	}
+	n.mu.RLock()
+	t.headerPageLock.RUnlock()
+	for !n.isLeafNode {
+		child, err := t.getGenericNode(n.children[n.branchNodeFindPointerIdx(key)])
+		if err != nil {
+			t.releaseRead(n)
+			return nil, err
+		}
+		child.mu.RLock()
+		t.releaseRead(n)
+		n = child
+	}
+	return n, nil
+}
+
+// releaseRead gives back the read latch and the pin of n, n has not been modified
+func (t *btreeCursor) releaseRead(n *genericNode) {
+	n.mu.RUnlock()
+	t.bpm.UnpinPage(n.osPage.GetPageID(), false)
+}
+
+// deleteSafe reports whether n stays at least half full, or keeps a child if it is the root,
+// once it loses an entry, so that the deletion does not change its ancestors
+func (t *btreeCursor) deleteSafe(n *genericNode, isRoot bool) bool {
+	if isRoot {
+		return n.isLeafNode || n.size > 1
+	}
+	return n.size-1 >= t._header.nodeSize/2
+}
+
+func (t *btreeCursor) delete(key keyT) (err error) {
 	curs := tx{}
-	// cur.stack from root -> nearest parent
-	err := curs.searchLeafNode(t, key)
+	defer curs.releaseInto(t, &err)
+	// cur.stack from the highest node that may change -> leaf
+	err = curs.searchLeafNode(t, key, t.deleteSafe)
 	if err != nil {
-		return fmt.Errorf("searchLeafNode error: %v", err)
+		return fmt.Errorf("searchLeafNode error: %w", err)
 	}
-	defer curs.unpinPages(t.bpm)
 
 	breadCrumb, ok := curs.popNext()
 	if !ok {
@@ -134,169 +438,193 @@ func (t *btreeCursor) delete(key keyT) error {
 	// normal deletion
 	idx, exact := t.leafNodeFindKeySlot(n, key)
 	if !exact {
-		return fmt.Errorf("key %v does not exist", key)
+		return fmt.Errorf("key %v: %w", key, ErrNotFound)
+	}
+	parInfo, ok := curs.popNext()
+	// n stays at least half full or is the root, its ancestors were released on the way down
+	if !ok {
+		_leafNodeRemove(n, idx)
+		return nil
+	}
+	thisNodeIdx := breadCrumb.idx
+	par := parInfo.node
+	left, right, err := t.latchSiblings(&curs, par, thisNodeIdx, n)
+	if err != nil {
+		return err
+	}
+	// whatever a merge reads is fetched before anything changes, so that a failed read
+	// leaves the tree as it was. A merge relinks the leaf after the pair it merges
+	mergedRight := n
+	if left == nil {
+		mergedRight = right
+	}
+	if _, err := t.getSiblingLeaf(&curs, mergedRight.next); err != nil {
+		return err
+	}
+	if err := t.pinBranchSiblings(&curs, parInfo.idx); err != nil {
+		return err
 	}
 	_leafNodeRemove(n, idx)
-	if n.size < t._header.nodeSize/2 {
-		parInfo, ok := curs.popNext()
-		thisNodeIdx := breadCrumb.idx
-		// n has no parent which means n is a root+leaf node
+	// check if we can borrow from cousin
+	if t._tryBorrowLeafKey(par, thisNodeIdx, left, n, right) {
+		return nil
+	}
+
+	var maybeNewRoot *genericNode
+	// must merge with either previous or next cousins
+	if left != nil {
+		if err := t.mergeLeafNodeRightToLeft(&curs, par, thisNodeIdx, left, n); err != nil {
+			return err
+		}
+		maybeNewRoot = left
+	} else if right != nil {
+		if err := t.mergeLeafNodeRightToLeft(&curs, par, thisNodeIdx+1, n, right); err != nil {
+			return err
+		}
+		maybeNewRoot = n
+	} else {
+		_assert(false, "should not reach here")
+	}
+	// the leaves are consistent again, writers splitting a leaf latch its right sibling
+	// while holding the branches above it, give the leaves back before latching branches
+	curs.unlatch(true)
+
+	curBranch := par
+	refIdx := parInfo.idx
+	// for parInCursor, ok := curs.popNext(); ok && curBranch.size < t._header.nodeSize/2; {
+	for {
+		parInCursor, ok := curs.popNext()
 		if !ok {
+			// no more parent, curBranch is either the root or stays at least half full
+			if curBranch.size == 0 {
+				// the header is latched while the root may change
+				t._header.rootPgid = nodeID(maybeNewRoot.osPage.GetPageID())
+				curs.headerChanged()
+				curBranch.isDeleted = true
+				curs.addDelete(nodeID(curBranch.osPage.GetPageID()))
+			}
+			// a root may be less than half full
 			return nil
 		}
-		par := parInfo.node
-		// check if we can borrow from cousin
-		done, err := t._tryBorrowLeafKey(par, thisNodeIdx, n)
+		if curBranch.size >= t._header.nodeSize/2 {
+			return nil
+		}
+		// ok && curBranch.size < t._header.nodeSize/2
+		// parent of current branch
+		newPar := parInCursor.node
+		left, right, err := t.latchSiblings(&curs, newPar, refIdx, curBranch)
 		if err != nil {
 			return err
 		}
-		if done {
+		if t._tryBorrowBranchKey(newPar, refIdx, left, curBranch, right) {
 			return nil
 		}
 
-		var maybeNewRoot *genericNode
-		// must merge with either previous or next cousins
-		if thisNodeIdx > 0 {
-			leftPageID := par.children[thisNodeIdx-1]
-			leftPage, err := t.getGenericNode(leftPageID)
-			if err != nil {
-				return err
-			}
-			t.mergeLeafNodeRightToLeft(par, thisNodeIdx, leftPage, n)
-			curs.addUnpin(leftPageID)
-			maybeNewRoot = leftPage
-		} else if thisNodeIdx < int(par.size) {
-			rightPageID := par.children[thisNodeIdx+1]
-			rightPage, err := t.getGenericNode(rightPageID)
-			if err != nil {
-				return err
-			}
-			t.mergeLeafNodeRightToLeft(par, thisNodeIdx+1, n, rightPage)
-			maybeNewRoot = n
+		if left != nil {
+			t.mergeBranchNodeRightToLeft(&curs, newPar, refIdx, left, curBranch)
+			maybeNewRoot = left
+		} else if right != nil {
+			t.mergeBranchNodeRightToLeft(&curs, newPar, refIdx+1, curBranch, right)
+			maybeNewRoot = curBranch
 		} else {
 			_assert(false, "should not reach here")
 		}
+		// this parent may have be less than half full, continue
+		curBranch = newPar
+		refIdx = parInCursor.idx
+	}
+}
 
-		curBranch := par
-		refIdx := parInfo.idx
-		// for parInCursor, ok := curs.popNext(); ok && curBranch.size < t._header.nodeSize/2; {
-		for {
-			parInCursor, ok := curs.popNext()
-			if !ok {
-				// no more parent, which means curBranch is root node
-				if curBranch.size == 0 {
-					t._header.rootPgid = nodeID(maybeNewRoot.osPage.GetPageID())
-					curs.addFlush(0)
-					return nil
-				}
+// pinBranchSiblings pins the siblings of the branches left on the path of tx, those merges
+// up the path may latch, idx is the index of the lowest of them in its parent. They are
+// only pinned, leaves are given back before branches are latched
+func (t *btreeCursor) pinBranchSiblings(tx *tx, idx int) error {
+	for i := len(tx.breadCrumbs) - 1; i >= 0; i-- {
+		par := tx.breadCrumbs[i].node
+		for _, sibling := range []int{idx - 1, idx + 1} {
+			if sibling < 0 || sibling > int(par.size) {
+				continue
 			}
-			if curBranch.size >= t._header.nodeSize/2 {
-				return nil
-			}
-			// ok && curBranch.size < t._header.nodeSize/2
-			// parent of current branch
-			newPar := parInCursor.node
-			done, err := t._tryBorrowBranchKey(&curs, newPar, refIdx, curBranch)
-			if err != nil {
+			if _, err := t.getGenericNode(par.children[sibling]); err != nil {
 				return err
 			}
-
-			if done {
-				return nil
-			}
-
-			if refIdx > 0 {
-				leftPageID := newPar.children[refIdx-1]
-				leftPage, err := t.getGenericNode(leftPageID)
-				if err != nil {
-					return err
-				}
-				t.mergeBranchNodeRightToLeft(newPar, refIdx, leftPage, curBranch)
-				maybeNewRoot = leftPage
-			} else if refIdx < int(newPar.size) {
-				rightPageID := newPar.children[refIdx+1]
-				rightPage, err := t.getGenericNode(rightPageID)
-				if err != nil {
-					return err
-				}
-
-				t.mergeBranchNodeRightToLeft(newPar, refIdx+1, curBranch, rightPage)
-				maybeNewRoot = curBranch
-			} else {
-				_assert(false, "should not reach here")
-			}
-			// this parent may have be less than half full, continue
-			curBranch = newPar
-			refIdx = parInCursor.idx
+			tx.pinned = append(tx.pinned, par.children[sibling])
 		}
-		// reaching this code means that curBranch is a root node
+		idx = tx.breadCrumbs[i].idx
 	}
 	return nil
 }
 
-func (t *btreeCursor) _tryBorrowLeafKey(newPar *genericNode, refIdx int, curBranch *genericNode) (bool, error) {
+// latchSiblings write latches the children of par next to cur, the child at refIdx,
+// nil if there is none. par is write latched so no other writer can reach them.
+// Leaves are latched from left to right, the order in which the leaf chain is walked,
+// so the latch of cur is given back while its left sibling is latched. Branches are only
+// latched by writers holding their parent, cur keeps its latch since nodes below it may be latched
+func (t *btreeCursor) latchSiblings(tx *tx, par *genericNode, refIdx int, cur *genericNode) (left, right *genericNode, err error) {
 	if refIdx > 0 {
-		leftPageID := newPar.children[refIdx-1]
-		left, err := t.getGenericNode(leftPageID)
-		if err != nil {
-			return false, err
+		if cur.isLeafNode {
+			cur.mu.Unlock()
 		}
-		if left.size > t._header.nodeSize/2 {
-			// after borrow, parent nodesize stay the same, safe to return
-			t.leafBorrowLeftForRight(newPar, refIdx, left, curBranch)
-			t.bpm.UnpinPage(int(leftPageID), true)
-			return true, nil
+		left, err = t.getGenericNode(par.children[refIdx-1])
+		if err == nil {
+			left.mu.Lock()
+			tx.addLatched(left)
+		}
+		if cur.isLeafNode {
+			cur.mu.Lock()
 		}
-		// try borrow from prev cousin
-	}
-	if refIdx < int(newPar.size) {
-		rightPageID := newPar.children[refIdx+1]
-		right, err := t.getGenericNode(rightPageID)
 		if err != nil {
-			return false, err
+			return nil, nil, err
 		}
-		if right.size > t._header.nodeSize/2 {
-			// after borrow, parent nodesize stay the same, safe to return
-			t.leafBorrowRightForLeft(newPar, refIdx, curBranch, right)
-			t.bpm.UnpinPage(int(rightPageID), true)
-			return true, nil
+	}
+	if refIdx < int(par.size) {
+		right, err = t.getGenericNode(par.children[refIdx+1])
+		if err != nil {
+			return nil, nil, err
 		}
-		// try borrow from next cousin
+		right.mu.Lock()
+		tx.addLatched(right)
 	}
-	return false, nil
+	return left, right, nil
 }
 
-func (t *btreeCursor) _tryBorrowBranchKey(tx *tx, newPar *genericNode, refIdx int, curBranch *genericNode) (bool, error) {
-	if refIdx > 0 {
-		leftPageID := newPar.children[refIdx-1]
-		left, err := t.getGenericNode(leftPageID)
-		if err != nil {
-			return false, err
-		}
-		tx.addUnpin(leftPageID)
-		if left.size > t._header.nodeSize/2 {
-			// after borrow, parent nodesize stay the same, safe to return
-			t.borrowLeftForRight(newPar, refIdx, left, curBranch)
-			return true, nil
-		}
-		// try borrow from prev cousin
+func (t *btreeCursor) _tryBorrowLeafKey(newPar *genericNode, refIdx int, left, curBranch, right *genericNode) bool {
+	// try borrow from prev cousin
+	if left != nil && left.size > t._header.nodeSize/2 {
+		// after borrow, parent nodesize stay the same, safe to return
+		t.leafBorrowLeftForRight(newPar, refIdx, left, curBranch)
+		return true
 	}
-	if refIdx < int(newPar.size) {
-		rightPageID := newPar.children[refIdx+1]
-		right, err := t.getGenericNode(rightPageID)
-		if err != nil {
-			return false, err
-		}
-		tx.addUnpin(rightPageID)
-		if right.size > t._header.nodeSize/2 {
-			// after borrow, parent nodesize stay the same, safe to return
-			t.borrowRightForLeft(newPar, refIdx, curBranch, right)
-			return true, nil
-		}
-		// try borrow from next cousin
+	// try borrow from next cousin
+	if right != nil && right.size > t._header.nodeSize/2 {
+		// after borrow, parent nodesize stay the same, safe to return
+		t.leafBorrowRightForLeft(newPar, refIdx, curBranch, right)
+		return true
 	}
+	return false
+}
 
-	return false, nil
+func (t *btreeCursor) _tryBorrowBranchKey(newPar *genericNode, refIdx int, left, curBranch, right *genericNode) bool {
+	// try borrow from prev cousin
+	if left != nil && t.branchCanLend(left, curBranch) {
+		// after borrow, parent nodesize stay the same, safe to return
+		t.borrowLeftForRight(newPar, refIdx, left, curBranch)
+		return true
+	}
+	// try borrow from next cousin
+	if right != nil && t.branchCanLend(right, curBranch) {
+		// after borrow, parent nodesize stay the same, safe to return
+		t.borrowRightForLeft(newPar, refIdx, curBranch, right)
+		return true
+	}
+	return false
+}
+
+// branchCanLend reports whether sibling should lend a key to curBranch rather than be merged
+// with it. Merging pulls down a key from the parent, with an even node size a sibling that is
+// exactly half full would fill the merged node up, so it lends instead
+func (t *btreeCursor) branchCanLend(sibling, curBranch *genericNode) bool {
+	return sibling.size > t._header.nodeSize/2 || sibling.size+curBranch.size+1 >= t._header.nodeSize
 }
 
 func (t *btreeCursor) borrowRightForLeft(par *genericNode, leftIdx int, left, right *genericNode) {
@@ -388,7 +716,12 @@ func (t *btreeCursor) borrowLeftForRight(par *genericNode, rightIdx int, left, r
 	par.keys[rightIdx-1] = lastKey
 }
 
-func (t *btreeCursor) mergeLeafNodeRightToLeft(par *genericNode, rightPointerIdx int, left, right *genericNode) {
+func (t *btreeCursor) mergeLeafNodeRightToLeft(tx *tx, par *genericNode, rightPointerIdx int, left, right *genericNode) error {
+	// delete has latched the leaf after right before changing anything
+	after, err := t.getSiblingLeaf(tx, right.next)
+	if err != nil {
+		return err
+	}
 	keySplitIdx := rightPointerIdx - 1
 	// left values + right values
 	high, low := left.size, left.size+right.size
@@ -403,12 +736,32 @@ func (t *btreeCursor) mergeLeafNodeRightToLeft(par *genericNode, rightPointerIdx
 	par.children[par.size] = invalidID
 	par.size--
 	left.next = right.next
+	if after != nil {
+		after.prev = nodeID(left.osPage.GetPageID())
+	}
 
-	deleted := t.bpm.DeletePage(right.osPage.GetPageID())
-	if !deleted {
-		// some other thread is using this deleted page, should detect when
-		panic("delete page failed")
+	// right page is still pinned by this tx, delete it when the tx is released
+	right.isDeleted = true
+	tx.addDelete(nodeID(right.osPage.GetPageID()))
+	return nil
+}
+
+// getSiblingLeaf returns the leaf pageID write latched by tx, nil if pageID is not a leaf link.
+// It is the right neighbour of a leaf tx holds, leaves are latched from left to right
+func (t *btreeCursor) getSiblingLeaf(tx *tx, pageID nodeID) (*genericNode, error) {
+	if pageID == 0 || pageID == invalidID {
+		return nil, nil
 	}
+	if leaf := tx.findLatched(pageID); leaf != nil {
+		return leaf, nil
+	}
+	leaf, err := t.getGenericNode(pageID)
+	if err != nil {
+		return nil, err
+	}
+	leaf.mu.Lock()
+	tx.addLatched(leaf)
+	return leaf, nil
 }
 
 // 			root:3
@@ -428,7 +781,7 @@ func (t *btreeCursor) mergeLeafNodeRightToLeft(par *genericNode, rightPointerIdx
 // 			root:2            3
 // 		|  				|	 	 		|
 // 		1 				2				3
-func (t *btreeCursor) mergeBranchNodeRightToLeft(par *genericNode, rightPointerIdx int, left, right *genericNode) {
+func (t *btreeCursor) mergeBranchNodeRightToLeft(tx *tx, par *genericNode, rightPointerIdx int, left, right *genericNode) {
 	// left pointers + right pointers
 	low, high := left.size+1, left.size+1+right.size+1
 	n := copy(left.children[low:high], right.children[:right.size+1])
@@ -453,20 +806,24 @@ func (t *btreeCursor) mergeBranchNodeRightToLeft(par *genericNode, rightPointerI
 	// empty last children because of shrink
 	par.children[par.size] = invalidID
 	par.size--
-	deleted := t.bpm.DeletePage(right.osPage.GetPageID())
-	if !deleted {
-		panic("delete branch page failed")
-	}
+	right.isDeleted = true
+	tx.addDelete(nodeID(right.osPage.GetPageID()))
 }
 
-func (t *btreeCursor) insert(key keyT, val int64) error {
+// insertSafe reports whether n has room for one more entry without splitting,
+// so that the insertion does not change its ancestors
+func (t *btreeCursor) insertSafe(n *genericNode, isRoot bool) bool {
+	return n.size+1 < t._header.nodeSize
+}
+
+func (t *btreeCursor) insert(key keyT, val int64) (err error) {
 	tx := tx{}
-	// cur.stack from root -> nearest parent
-	err := tx.searchLeafNode(t, key)
+	defer tx.releaseInto(t, &err)
+	// cur.stack from the highest node that may change -> leaf
+	err = tx.searchLeafNode(t, key, t.insertSafe)
 	if err != nil {
 		return err
 	}
-	defer tx.unpinPages(t.bpm)
 	breadCrumb, ok := tx.popNext()
 	if !ok {
 		panic("not reached")
@@ -474,107 +831,157 @@ func (t *btreeCursor) insert(key keyT, val int64) error {
 	n := breadCrumb.node
 
 	// normal insertion
-	{
-		idx, exact := t.leafNodeFindKeySlot(n, key)
-		if exact {
-			return fmt.Errorf("duplicate key found %v", key)
-		}
-		copy(n.datas[idx+1:n.size+1], n.datas[idx:n.size])
-		n.datas[idx] = valT{
-			val: keyT{main: int64(val)},
-			key: key,
+	idx, exact := t.leafNodeFindKeySlot(n, key)
+	if exact {
+		return fmt.Errorf("key %v: %w", key, ErrKeyExists)
+	}
+	var split splitNodes
+	if !t.insertSafe(n, false) {
+		if split, err = t.allocSplit(&tx, n); err != nil {
+			return err
 		}
-		n.size++
 	}
+	copy(n.datas[idx+1:n.size+1], n.datas[idx:n.size])
+	n.datas[idx] = valT{
+		val: keyT{main: int64(val)},
+		key: key,
+	}
+	n.size++
 
 	if n.size < t._header.nodeSize {
 		return nil
 	}
-	orphan, splitKey, err := t.splitLeafNode(&tx, n)
-	if err != nil {
-		return err
-	}
-
-	// retrieve currentParent from cursor latest stack
-	// if currentParent ==nil, create new currentParent(in this case current leaf is also the root node)
-	var currentParent *genericNode
-
-	for len(tx.breadCrumbs) > 0 {
-		curStack := tx.breadCrumbs[len(tx.breadCrumbs)-1]
-		currentParent = curStack.node
-		tx.breadCrumbs = tx.breadCrumbs[:len(tx.breadCrumbs)-1]
-
-		idx, err := currentParent.findUniquePointerIdx(splitKey)
-		if err != nil {
-			return err
-		}
-
-		currentParent._insertPointerAtIdx(int64(idx), &orphanNode{
-			key:        splitKey,
-			rightChild: orphan,
-		}, t._header.nodeSize)
-		if currentParent.size < t._header.nodeSize {
-			return nil
-		}
-		// this parent is also full
+	orphan, splitKey := t.splitLeafNode(n, split.after, split.leaf)
 
-		newOrphan, newSplitKey, err := t.splitBranchNode(&tx, currentParent)
-		if err != nil {
+	// every split hands a pointer to its parent, up to the highest node on the path
+	root := n
+	for _, newBranch := range split.branches {
+		parent, _ := tx.popNext()
+		if err := t.insertPointer(parent.node, splitKey, orphan); err != nil {
 			return err
 		}
-
-		// let the next iteration handle this split with new parent propagated up the stack
-		orphan = newOrphan
-		splitKey = newSplitKey
+		// this parent is also full, allocSplit has allocated newBranch for it
+		orphan, splitKey = t.splitBranchNode(parent.node, newBranch)
+		root = parent.node
+	}
+	if split.root == nil {
+		// the highest node on the path has room for the pointer
+		parent, _ := tx.popNext()
+		return t.insertPointer(parent.node, splitKey, orphan)
 	}
 	// if reach this line, the higest level parent (root) has been recently split
-	root, err := t.getRootNode()
-	if err != nil {
+	_assert(tx.header != nil, "root split without holding the header latch")
+	newRoot := split.root
+	newRoot.level = root.level + 1
+	newRoot.children[0] = nodeID(root.osPage.GetPageID())
+	if err := t.insertPointer(newRoot, splitKey, orphan); err != nil {
 		return err
 	}
+	t._header.rootPgid = nodeID(newRoot.osPage.GetPageID())
 
-	newLevel := root.level + 1
+	tx.headerChanged()
+	return nil
+}
 
-	newRoot, err := t.newEmptyBranchNode()
+// insertPointer adds the pointer to orphan, the right half of a split child, to par
+func (t *btreeCursor) insertPointer(par *genericNode, splitKey keyT, orphan *genericNode) error {
+	idx, err := par.findUniquePointerIdx(splitKey)
 	if err != nil {
 		return err
 	}
-	tx.addUnpin(nodeID(newRoot.osPage.GetPageID()))
-	newRoot.level = newLevel
-	newRoot.children[0] = nodeID(root.osPage.GetPageID())
-	newRoot._insertPointerAtIdx(0, &orphanNode{
+	par._insertPointerAtIdx(int64(idx), &orphanNode{
 		key:        splitKey,
 		rightChild: orphan,
 	}, t._header.nodeSize)
-	t._header.rootPgid = nodeID(newRoot.osPage.GetPageID())
-
-	// headerPage Updated, flush instead of unpin (header page is always pinned)
-	tx.addFlush(0)
 	return nil
 }
 
+// splitNodes holds what an insertion into a full leaf needs to split it and its full ancestors
+type splitNodes struct {
+	// right sibling of the leaf, nil for the last leaf
+	after *genericNode
+	leaf  *genericNode
+	// one new branch for every full ancestor, from the parent of the leaf upwards
+	branches []*genericNode
+	// nil unless the root splits
+	root *genericNode
+}
+
+// allocSplit latches the right sibling of leaf n and allocates every node the insertion
+// will split into, before the tree is modified, so that a failed read or allocation leaves
+// the tree as it was. Full ancestors are the breadcrumbs that are not insert safe, the root
+// splits if all of them are. The nodes allocated are deleted when the allocation fails
+func (t *btreeCursor) allocSplit(tx *tx, n *genericNode) (s splitNodes, err error) {
+	var allocated []*genericNode
+	defer func() {
+		if err != nil {
+			for _, node := range allocated {
+				tx.addDelete(nodeID(node.osPage.GetPageID()))
+			}
+		}
+	}()
+	alloc := func(newNode func() (*genericNode, error)) (*genericNode, error) {
+		node, err := newNode()
+		if err != nil {
+			return nil, err
+		}
+		tx.addUnpin(nodeID(node.osPage.GetPageID()))
+		allocated = append(allocated, node)
+		return node, nil
+	}
+	if s.after, err = t.getSiblingLeaf(tx, n.next); err != nil {
+		return splitNodes{}, err
+	}
+	if s.leaf, err = alloc(t.newEmptyLeafNode); err != nil {
+		return splitNodes{}, err
+	}
+	for i := len(tx.breadCrumbs) - 1; i >= 0; i-- {
+		if t.insertSafe(tx.breadCrumbs[i].node, false) {
+			return s, nil
+		}
+		branch, err := alloc(t.newEmptyBranchNode)
+		if err != nil {
+			return splitNodes{}, err
+		}
+		s.branches = append(s.branches, branch)
+	}
+	if s.root, err = alloc(t.newEmptyBranchNode); err != nil {
+		return splitNodes{}, err
+	}
+	return s, nil
+}
+
 func (t *btreeCursor) newEmptyLeafNode() (*genericNode, error) {
-	page := t.bpm.NewPage()
-	if page == nil {
-		return nil, fmt.Errorf("buffer full")
+	page, err := t.bpm.NewPage()
+	if err != nil {
+		return nil, err
 	}
 	newLeaf := castLeafFromEmpty(int(t._header.nodeSize), page)
 	return newLeaf, nil
 }
 
 func (t *btreeCursor) newEmptyBranchNode() (*genericNode, error) {
-	page := t.bpm.NewPage()
-	if page == nil {
-		return nil, fmt.Errorf("buffer full")
+	page, err := t.bpm.NewPage()
+	if err != nil {
+		return nil, err
 	}
 	newBranch := castBranchFromEmpty(int(t._header.nodeSize), page)
 	return newBranch, nil
 }
 
 type tx struct {
+	// write latched, from the highest node the operation may change down to the leaf
 	breadCrumbs []breadCrumb
+	// write latched nodes popped from breadCrumbs or off the path, e.g. siblings
+	latched []*genericNode
+	// held while the root may change
+	header      *sync.RWMutex
 	tobeCleaned []nodeID
-	tobeFlushed []nodeID
+	tobeDeleted []nodeID
+	// pinned ahead of being latched, they are given back clean
+	pinned []nodeID
+	// the header page has been modified
+	headerDirty bool
 }
 type breadCrumb struct {
 	node *genericNode
@@ -587,7 +994,7 @@ func (c *tx) popNext() (breadCrumb, bool) {
 	}
 	ret := c.breadCrumbs[len(c.breadCrumbs)-1]
 	c.breadCrumbs = c.breadCrumbs[:len(c.breadCrumbs)-1]
-	c.addUnpin(nodeID(ret.node.osPage.GetPageID()))
+	c.addLatched(ret.node)
 	return ret, true
 }
 
@@ -609,47 +1016,49 @@ func (t *btreeCursor) getRootNode() (*genericNode, error) {
 	return node, nil
 }
 
-// TODO: add some cursor to manage lock
-func (c *tx) searchLeafNode(t *btreeCursor, searchKey keyT) error {
+// searchLeafNode descends to the leaf of searchKey with write latches, starting with the
+// header latch. The latch of a child is taken before its ancestors are released, and they
+// are only released once the child is safe, i.e. the operation cannot split or merge it,
+// so the breadcrumbs hold every node the operation may change. Lookups run in parallel
+// with the parts of the descent that only hold safe nodes
+func (c *tx) searchLeafNode(t *btreeCursor, searchKey keyT, safe func(n *genericNode, isRoot bool) bool) error {
 	_assert(len(c.breadCrumbs) == 0, "length of cursor is not cleaned up")
+	t.headerPageLock.Lock()
+	c.header = t.headerPageLock
 	root, err := t.getRootNode()
 	if err != nil {
-		return fmt.Errorf("failed to get root node: %v", err)
+		return fmt.Errorf("failed to get root node: %w", err)
 	}
+	root.mu.Lock()
 	var curNode = root
 	curLevel := root.level
 	var pointerIdx int
-	for !curNode.isLeafNode {
-		if curLevel <= 0 {
-			fmt.Println(curNode.level)
-			fmt.Println(root.level)
-		}
-		_assert(curLevel > 0, "reached level 0 node but still have not found leaf node")
+	isRoot := true
+	for {
 		c.breadCrumbs = append(c.breadCrumbs, breadCrumb{
 			node: curNode,
 			idx:  pointerIdx,
 		})
+		if safe(curNode, isRoot) {
+			c.releaseAncestors(t)
+		}
+		if curNode.isLeafNode {
+			return nil
+		}
+		_assert(curLevel > 0, "reached level 0 node but still have not found leaf node")
 		pointerIdx = curNode.branchNodeFindPointerIdx(searchKey)
-		if curNode.children[pointerIdx] != invalidID {
-			nextNodePageID := curNode.children[pointerIdx]
-
-			if nextNodePageID == 0 {
-				nextNodePageID = 4
-			}
-			curNode, err = t.getGenericNode(nextNodePageID)
-			if err != nil {
-				return err
-			}
-			curLevel--
-			continue
+		nextNodePageID := curNode.children[pointerIdx]
+		if nextNodePageID == invalidID {
+			panic(fmt.Sprintf("cannot find correct node for key %v", searchKey))
+		}
+		curNode, err = t.getGenericNode(nextNodePageID)
+		if err != nil {
+			return err
 		}
-		panic(fmt.Sprintf("cannot find correct node for key %v", searchKey))
+		curNode.mu.Lock()
+		curLevel--
+		isRoot = false
 	}
-	c.breadCrumbs = append(c.breadCrumbs, breadCrumb{
-		node: curNode,
-		idx:  pointerIdx,
-	})
-	return nil
 }
 
 type orphanNode struct {
@@ -670,12 +1079,9 @@ func (n *genericNode) _insertPointerAtIdx(idx int64, orphan *orphanNode, maxNode
 	n.size++
 }
 
-func (t *btreeCursor) splitBranchNode(tx *tx, n *genericNode) (*genericNode, keyT, error) {
-	newLeftNode, err := t.newEmptyBranchNode()
-	if err != nil {
-		return nil, keyT{}, err
-	}
-	tx.addUnpin(nodeID(newLeftNode.osPage.GetPageID()))
+// splitBranchNode moves the upper half of n to newLeftNode, an empty branch.
+// splitKey returned to create new pointer entry on parent
+func (t *btreeCursor) splitBranchNode(n, newLeftNode *genericNode) (*genericNode, keyT) {
 	newLeftNode.level = n.level
 	splitIdx := t._header.nodeSize / 2 // right >= left
 	splitKey := n.keys[splitIdx]
@@ -693,17 +1099,13 @@ func (t *btreeCursor) splitBranchNode(tx *tx, n *genericNode) (*genericNode, key
 	}
 
 	n.size = splitIdx
-	return newLeftNode, splitKey, nil
+	return newLeftNode, splitKey
 }
 
+// splitLeafNode moves the upper half of n to newLeaf, an empty leaf, after is the right
+// sibling of n, nil for the last leaf.
 // splitKey returned to create new pointer entry on parent
-func (t *btreeCursor) splitLeafNode(tx *tx, n *genericNode) (*genericNode, keyT, error) {
-	newLeaf, err := t.newEmptyLeafNode()
-	if err != nil {
-		return nil, keyT{}, err
-	}
-	tx.addUnpin(nodeID(newLeaf.osPage.GetPageID()))
-
+func (t *btreeCursor) splitLeafNode(n, after, newLeaf *genericNode) (*genericNode, keyT) {
 	idx := t._header.nodeSize / 2 // right >= left
 	copy(newLeaf.datas[:n.size-idx], n.datas[idx:n.size])
 	// hacky empty values
@@ -714,9 +1116,13 @@ func (t *btreeCursor) splitLeafNode(tx *tx, n *genericNode) (*genericNode, keyT,
 	n.size = idx
 
 	newLeaf.next = n.next
+	newLeaf.prev = nodeID(n.osPage.GetPageID())
 	n.next = nodeID(newLeaf.osPage.GetPageID())
+	if after != nil {
+		after.prev = n.next
+	}
 	splitKey := newLeaf.datas[0].key
-	return newLeaf, splitKey, nil
+	return newLeaf, splitKey
 }
 
 // func (t *btreeCursor) insertVal(n *leafNode, val treeVal) error {
@@ -1,10 +1,14 @@
 package bt2
 
 import (
+	"buff"
+	"bytes"
+	"compress/flate"
 	"fmt"
+	"math/rand"
 	"os"
 	"path/filepath"
-	"strings"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -76,20 +80,50 @@ func Test_searchIdx(t *testing.T) {
 }
 func Test_NewBtree(t *testing.T) {
 	var nodeSize int64 = 10
-	file := fmt.Sprintf("test-%s.db", t.Name())
-	defer os.Remove(file)
-	tr := newBtree(t, file, nodeSize)
-	tr.bpm.Close()
+	disk := newMemDisk(t)
+	tr := newBtree(t, disk, nodeSize)
+	assert.NoError(t, tr.Close())
+
+	// reopen should see the persisted header
+	tr = newBtree(t, disk, nodeSize)
+	assert.NoError(t, tr.Close())
+
+	file := filepath.Join(t.TempDir(), "test.db")
+	tr, err := NewBtree(file, nodeSize)
+	assert.NoError(t, err)
+	assert.NoError(t, tr.Close())
+	tr, err = NewBtree(file, nodeSize)
+	assert.NoError(t, err)
+	assert.Equal(t, nodeID(1), tr._header.rootPgid)
+	assert.NoError(t, tr.Close())
+}
+
+func newMemDisk(t *testing.T, opts ...buff.DiskOption) *buff.MemDiskManager {
+	disk, err := buff.NewMemDiskManager(opts...)
+	assert.NoError(t, err)
+	return disk
+}
+
+func newFaultDisk(t *testing.T, seed int64) *buff.FaultDiskManager {
+	disk, err := buff.NewFaultDiskManager(seed)
+	assert.NoError(t, err)
+	return disk
 }
 
-func newBtree(t *testing.T, filename string, nsize int64) *btreeCursor {
-	tr := NewBtree(filename, nsize)
+func newBtree(t *testing.T, disk buff.DiskManager, nsize int64) *btreeCursor {
+	tr, err := NewBtreeOnDisk(disk, nsize)
+	assert.NoError(t, err)
 	assert.Equal(t, headerFlagInit, tr._header.flags&headerFlagInit)
 	assert.Equal(t, nodeID(1), tr._header.rootPgid)
 	assert.Equal(t, nsize, tr._header.nodeSize)
 	return tr
 }
 
+// ownPool returns the pool a tree created without WithBufferPool stores its pages in
+func ownPool(tr *btreeCursor) *buff.BufferPool {
+	return tr.bpm.(*buff.BufferPool)
+}
+
 func Test_btreeDelete(t *testing.T) {
 
 	// cur.stack from root -> nearest parent
@@ -191,13 +225,8 @@ func Test_btreeDelete(t *testing.T) {
 	}
 	for idx, tc := range tcases {
 		t.Run(fmt.Sprintf("delete %d", idx), func(t *testing.T) {
-			file := fmt.Sprintf("test-%s.db", t.Name())
-			file = strings.ReplaceAll(file, string(filepath.Separator), "_")
-			tr := newBtree(t, file, tc.nodesize)
-			defer func() {
-				tr.bpm.Close()
-				os.Remove(file)
-			}()
+			tr := newBtree(t, newMemDisk(t), tc.nodesize)
+			defer tr.bpm.Close()
 			for _, insertItem := range tc.insertions {
 				assert.NoError(t, tr.insert(keyT{main: insertItem}, insertItem))
 			}
@@ -212,14 +241,12 @@ func Test_btreeDelete(t *testing.T) {
 			} else {
 				assert.Equal(t, tc.rootKeys, root.keys[:root.size])
 			}
-			cur := tx{}
-			err = cur.searchLeafNode(tr, keyT{main: -1})
+			leftmost, err := tr.searchLeafRead(keyT{main: -1})
 			assert.NoError(t, err)
-			leftmost, bool := cur.popNext()
-			assert.True(t, bool)
+			defer tr.releaseRead(leftmost)
 
 			var (
-				current = leftmost.node
+				current = leftmost
 			)
 			for idx := range tc.leafKeyVals {
 				expectVals := tc.leafKeyVals[idx]
@@ -301,13 +328,8 @@ func Test_btreeInsert(t *testing.T) {
 	}
 	for idx, tc := range tcases {
 		t.Run(fmt.Sprintf("insert %d", idx), func(t *testing.T) {
-			file := fmt.Sprintf("test-%s.db", t.Name())
-			file = strings.ReplaceAll(file, string(filepath.Separator), "_")
-			tr := newBtree(t, file, tc.nodesize)
-			defer func() {
-				tr.bpm.Close()
-				os.Remove(file)
-			}()
+			tr := newBtree(t, newMemDisk(t), tc.nodesize)
+			defer tr.bpm.Close()
 			for _, insertItem := range tc.insertions {
 				assert.NoError(t, tr.insert(keyT{main: insertItem}, insertItem))
 			}
@@ -316,14 +338,12 @@ func Test_btreeInsert(t *testing.T) {
 			assert.NotNil(t, root.branchData)
 			assert.Equal(t, tc.rootKeys, root.keys[:root.size])
 
-			cur := tx{}
 			// search left most leaf node
-			err = cur.searchLeafNode(tr, keyT{main: -1})
+			leftmost, err := tr.searchLeafRead(keyT{main: -1})
 			assert.NoError(t, err)
-			leftmost, bool := cur.popNext()
-			assert.True(t, bool)
+			defer tr.releaseRead(leftmost)
 			var (
-				current = leftmost.node
+				current = leftmost
 			)
 			for idx := range tc.leafKeyVals {
 				expectVals := tc.leafKeyVals[idx]
@@ -364,3 +384,214 @@ func keysFromVals(vals []valT) (ks []keyT) {
 	}
 	return ks
 }
+
+func Test_btreeReleasesPages(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.db")
+	tr, err := NewBtree(file, 3)
+	assert.NoError(t, err)
+	for _, item := range sequentialUntil(30) {
+		assert.NoError(t, tr.insert(keyT{main: item}, item))
+	}
+	for _, item := range sequentialUntil(25) {
+		assert.NoError(t, tr.delete(keyT{main: item}))
+	}
+	// every page touched by insert/delete has been unpinned
+	assert.NoError(t, tr.Close())
+
+	// merged pages have been deallocated and are reused first
+	tr, err = NewBtree(file, 3)
+	assert.NoError(t, err)
+	for _, item := range sequentialUntil(25) {
+		assert.NoError(t, tr.insert(keyT{main: item}, item))
+	}
+	assert.NoError(t, tr.Close())
+	info, err := os.Stat(file)
+	assert.NoError(t, err)
+	sizeAfterReuse := info.Size()
+
+	tr, err = NewBtree(file, 3)
+	assert.NoError(t, err)
+	for _, item := range sequentialUntil(25) {
+		assert.NoError(t, tr.delete(keyT{main: item}))
+	}
+	for _, item := range sequentialUntil(25) {
+		assert.NoError(t, tr.insert(keyT{main: item}, item))
+	}
+	assert.NoError(t, tr.Close())
+	info, err = os.Stat(file)
+	assert.NoError(t, err)
+	assert.Equal(t, sizeAfterReuse, info.Size())
+}
+
+func Test_btreeOnCompressedDisk(t *testing.T) {
+	dir := t.TempDir()
+	plainFile, compressedFile := filepath.Join(dir, "plain.db"), filepath.Join(dir, "compressed.db")
+	codec, err := buff.NewFlateCodec(flate.BestSpeed)
+	assert.NoError(t, err)
+	compressed, err := buff.NewMappedDiskManager(compressedFile, codec)
+	assert.NoError(t, err)
+	plain, err := buff.NewDiskManager(plainFile)
+	assert.NoError(t, err)
+
+	for _, disk := range []buff.DiskManager{plain, compressed} {
+		tr, err := NewBtreeOnDisk(disk, 10)
+		assert.NoError(t, err)
+		for _, item := range sequentialUntil(500) {
+			assert.NoError(t, tr.insert(keyT{main: item}, item))
+		}
+		assert.NoError(t, tr.Close())
+	}
+	plainInfo, err := os.Stat(plainFile)
+	assert.NoError(t, err)
+	compressedInfo, err := os.Stat(compressedFile)
+	assert.NoError(t, err)
+	assert.Less(t, compressedInfo.Size()*4, plainInfo.Size())
+
+	compressed, err = buff.NewMappedDiskManager(compressedFile, codec)
+	assert.NoError(t, err)
+	tr, err := NewBtreeOnDisk(compressed, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, sequentialUntil(500), scanKeys(t, tr))
+	assert.NoError(t, tr.Close())
+}
+
+func Test_btreeOnEncryptedDisk(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "encrypted.db")
+	open := func(key byte) *buff.MappedDiskManager {
+		codec, err := buff.NewAESGCMCodec(bytes.Repeat([]byte{key}, 32))
+		assert.NoError(t, err)
+		disk, err := buff.NewMappedDiskManager(file, codec)
+		assert.NoError(t, err)
+		return disk
+	}
+	tr, err := NewBtreeOnDisk(open(1), 10)
+	assert.NoError(t, err)
+	for _, item := range sequentialUntil(100) {
+		assert.NoError(t, tr.insert(keyT{main: item}, item))
+	}
+	assert.NoError(t, tr.Close())
+
+	_, err = NewBtreeOnDisk(open(2), 10)
+	assert.ErrorIs(t, err, buff.ErrPageAuthentication)
+	tr, err = NewBtreeOnDisk(open(1), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, sequentialUntil(100), scanKeys(t, tr))
+	assert.NoError(t, tr.Close())
+}
+
+func Test_btreeOnResizedPool(t *testing.T) {
+	bpm := buff.NewBufferPool(16, newMemDisk(t))
+	_, err := NewBtree("test.db", crashNodeSize, WithBufferPool(bpm))
+	assert.Error(t, err)
+	tr, err := NewBtree("", crashNodeSize, WithBufferPool(bpm))
+	assert.NoError(t, err)
+
+	for _, item := range sequentialUntil(200) {
+		if item == 100 {
+			assert.NoError(t, bpm.Resize(64))
+		}
+		assert.NoError(t, tr.insert(keyT{main: item}, item))
+	}
+	assert.NoError(t, bpm.Resize(16))
+	for _, item := range sequentialUntil(50) {
+		assert.NoError(t, tr.delete(keyT{main: item}))
+	}
+	assert.Equal(t, sequentialUntil(200)[50:], scanKeys(t, tr))
+	assert.NoError(t, tr.Close())
+
+	// the pool is still open and holds the tree
+	tr, err = NewBtreeOnDisk(nil, crashNodeSize, WithBufferPool(bpm))
+	assert.NoError(t, err)
+	assert.Equal(t, sequentialUntil(200)[50:], scanKeys(t, tr))
+	assert.NoError(t, tr.Close())
+	assert.NoError(t, bpm.Close())
+
+	_, err = NewBtreeOnDisk(newMemDisk(t), crashNodeSize, WithPoolSize(0))
+	assert.Error(t, err)
+	tr, err = NewBtreeOnDisk(newMemDisk(t), crashNodeSize, WithPoolSize(8))
+	assert.NoError(t, err)
+	assert.Equal(t, 8, ownPool(tr).Size())
+	assert.NoError(t, tr.Close())
+}
+
+func Test_btreeGet(t *testing.T) {
+	tr := newBtree(t, newMemDisk(t), crashNodeSize)
+	for _, item := range sequentialUntil(300) {
+		assert.NoError(t, tr.insert(keyT{main: item * 2}, item*20))
+	}
+	assert.NoError(t, tr.Sync())
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, item := range sequentialUntil(300) {
+				val, err := tr.get(keyT{main: item * 2})
+				assert.NoError(t, err)
+				assert.Equal(t, item*20, val)
+				_, err = tr.get(keyT{main: item*2 + 1})
+				assert.ErrorIs(t, err, ErrNotFound)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// only the header stays pinned and lookups dirty nothing
+	for _, f := range ownPool(tr).Frames() {
+		if f.PageID == 0 {
+			assert.Equal(t, 1, f.PinCount)
+			continue
+		}
+		assert.Zero(t, f.PinCount)
+		assert.False(t, f.Dirty)
+	}
+	assert.NoError(t, tr.Close())
+}
+
+// maxBranchSize returns the number of keys of the fullest branch below pageID
+func maxBranchSize(t *testing.T, tr *btreeCursor, pageID nodeID) int64 {
+	n, err := tr.getGenericNode(pageID)
+	assert.NoError(t, err)
+	defer tr.bpm.UnpinPage(int(pageID), false)
+	if n.isLeafNode {
+		return 0
+	}
+	size := n.size
+	for _, child := range n.children[:n.size+1] {
+		if childSize := maxBranchSize(t, tr, child); childSize > size {
+			size = childSize
+		}
+	}
+	return size
+}
+
+func Test_btreeBranchMergeWithEvenNodeSize(t *testing.T) {
+	// a branch merged with a sibling exactly half full would get nodeSize keys,
+	// the sibling must lend a key instead
+	for _, nodeSize := range []int64{4, 6} {
+		tr := newBtree(t, newMemDisk(t), nodeSize)
+		rnd := rand.New(rand.NewSource(nodeSize))
+		present := map[int64]bool{}
+		for step := 0; step < 300; step++ {
+			key := rnd.Int63n(200)
+			if present[key] {
+				assert.NoError(t, tr.delete(keyT{main: key}))
+			} else {
+				assert.NoError(t, tr.insert(keyT{main: key}, key))
+			}
+			present[key] = !present[key]
+			if !assert.Less(t, maxBranchSize(t, tr, tr._header.rootPgid), nodeSize, fmt.Sprintf("node size %d, step %d", nodeSize, step)) {
+				break
+			}
+		}
+		for key, ok := range present {
+			if ok {
+				val, err := tr.get(keyT{main: key})
+				assert.NoError(t, err)
+				assert.Equal(t, key, val)
+			}
+		}
+		assert.NoError(t, tr.Close())
+	}
+}
@@ -0,0 +1,301 @@
+package bt2
+
+import (
+	"buff"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// small nodes make deep trees out of a few hundred keys
+const crashNodeSize = 5
+
+// scanKeys walks the leaves from left to right and returns every key
+func scanKeys(t *testing.T, tr *btreeCursor) []int64 {
+	leaf, err := tr.searchLeafRead(keyT{main: -1})
+	assert.NoError(t, err)
+	tr.releaseRead(leaf)
+
+	var keys []int64
+	current := leaf
+	for {
+		for _, item := range current.datas[:current.size] {
+			keys = append(keys, item.key.main)
+		}
+		next := current.next
+		if next == 0 || next == invalidID {
+			return keys
+		}
+		current, err = tr.getGenericNode(next)
+		assert.NoError(t, err)
+		tr.bpm.UnpinPage(int(next), false)
+	}
+}
+
+// crashWorkload inserts keys 1..synced and syncs, then inserts the keys up to total
+// in an order drawn from seed and stops at the first error. It returns the number
+// of keys made durable by a successful Sync, keys 1..durable must survive a crash
+func crashWorkload(tr *btreeCursor, seed int64, synced, total int) (durable int, err error) {
+	for _, item := range sequentialUntil(int64(synced)) {
+		if err := tr.insert(keyT{main: item}, item); err != nil {
+			return 0, err
+		}
+	}
+	if err := tr.Sync(); err != nil {
+		return 0, err
+	}
+	rnd := rand.New(rand.NewSource(seed))
+	for _, idx := range rnd.Perm(total - synced) {
+		item := int64(synced + 1 + idx)
+		if err := tr.insert(keyT{main: item}, item); err != nil {
+			return synced, err
+		}
+	}
+	if err := tr.Sync(); err != nil {
+		return synced, err
+	}
+	return total, nil
+}
+
+func reopenAfterCrash(t *testing.T, disk *buff.FaultDiskManager) *btreeCursor {
+	tr, err := NewBtreeOnDisk(disk.Crash(buff.CrashDropAll), crashNodeSize)
+	assert.NoError(t, err)
+	return tr
+}
+
+func Test_btreeCrashKeepsSyncedKeys(t *testing.T) {
+	for seed := int64(0); seed < 5; seed++ {
+		disk := newFaultDisk(t, seed)
+		tr, err := NewBtreeOnDisk(disk, crashNodeSize)
+		assert.NoError(t, err)
+		durable, err := crashWorkload(tr, seed, 100, 300)
+		assert.NoError(t, err)
+		assert.Equal(t, 300, durable)
+
+		// unsynced inserts and deletes, evictions have written some of them
+		for _, item := range sequentialUntil(50) {
+			assert.NoError(t, tr.delete(keyT{main: item}))
+		}
+		for item := int64(301); item <= 400; item++ {
+			assert.NoError(t, tr.insert(keyT{main: item}, item))
+		}
+		assert.Greater(t, disk.Writes(), 0)
+
+		tr = reopenAfterCrash(t, disk)
+		assert.Equal(t, sequentialUntil(300), scanKeys(t, tr))
+		assert.NoError(t, tr.Close())
+	}
+}
+
+func Test_btreeRecoversFromWriteFaults(t *testing.T) {
+	const seed, synced, total = 3, 100, 300
+	dryRun := newFaultDisk(t, seed)
+	tr, err := NewBtreeOnDisk(dryRun, crashNodeSize)
+	assert.NoError(t, err)
+	_, err = crashWorkload(tr, seed, synced, total)
+	assert.NoError(t, err)
+	writes := dryRun.Writes()
+
+	recovered := 0
+	for n := 1; n <= writes; n += 7 {
+		for _, tear := range []bool{false, true} {
+			disk := newFaultDisk(t, seed)
+			if tear {
+				disk.TearWrite(n)
+			} else {
+				disk.FailWrite(n)
+			}
+			tr, err := NewBtreeOnDisk(disk, crashNodeSize)
+			if err != nil {
+				// the fault hit tree creation, nothing was synced yet
+				assert.ErrorIs(t, err, buff.ErrInjectedFault)
+				continue
+			}
+			durable, err := crashWorkload(tr, seed, synced, total)
+			assert.True(t, errors.Is(err, buff.ErrInjectedFault), "write %d: %v", n, err)
+
+			// every key up to the last successful Sync survives, whichever write failed
+			tr = reopenAfterCrash(t, disk)
+			keys := scanKeys(t, tr)
+			if durable == 0 {
+				assert.Empty(t, keys, "write %d", n)
+			} else {
+				assert.Equal(t, sequentialUntil(int64(durable)), keys, "write %d", n)
+				recovered++
+			}
+			assert.NoError(t, tr.Close())
+		}
+	}
+	assert.NotZero(t, recovered)
+}
+
+func Test_btreeRecoversFromReadFaults(t *testing.T) {
+	const synced, total = 100, 300
+	disk := newFaultDisk(t, 4)
+	tr, err := NewBtreeOnDisk(disk, crashNodeSize)
+	assert.NoError(t, err)
+	for _, item := range sequentialUntil(total) {
+		assert.NoError(t, tr.insert(keyT{main: item}, item))
+		if item == synced {
+			assert.NoError(t, tr.Sync())
+		}
+	}
+
+	// leftmost leaves have been evicted, deleting them reads them back
+	disk.SetFaultRate(0.2)
+	for _, item := range sequentialUntil(total) {
+		if err = tr.delete(keyT{main: item}); err != nil {
+			break
+		}
+	}
+	assert.ErrorIs(t, err, buff.ErrInjectedFault)
+
+	tr = reopenAfterCrash(t, disk)
+	assert.Equal(t, sequentialUntil(synced), scanKeys(t, tr))
+	assert.NoError(t, tr.Close())
+}
+
+func Test_btreeInsertSurvivesReadFaults(t *testing.T) {
+	disk := newFaultDisk(t, 6)
+	tr, err := NewBtreeOnDisk(disk, crashNodeSize, WithPoolSize(16))
+	assert.NoError(t, err)
+	rnd := rand.New(rand.NewSource(6))
+	keys := rnd.Perm(300)
+	failed := 0
+	for _, key := range keys {
+		item := int64(key + 1)
+		// the next read fails, be it on the way down or of the sibling of a leaf being split
+		disk.FailRead(1)
+		if err := tr.insert(keyT{main: item}, item); err != nil {
+			assert.ErrorIs(t, err, buff.ErrInjectedFault)
+			failed++
+			assert.NoError(t, tr.insert(keyT{main: item}, item))
+		}
+	}
+	assert.NotZero(t, failed)
+	// a fault may still be pending
+	_ = disk.ReadPage(0, make([]byte, buff.DefaultPageSize))
+
+	assert.Equal(t, sequentialUntil(300), scanKeys(t, tr))
+	for _, item := range sequentialUntil(300) {
+		val, err := tr.get(keyT{main: item})
+		assert.NoError(t, err)
+		assert.Equal(t, item, val)
+	}
+	assert.NoError(t, tr.Close())
+}
+
+func Test_btreeOperationsSurviveWriteFaults(t *testing.T) {
+	const seed, nodeSize, total = 1, 4, 200
+	keys := rand.New(rand.NewSource(seed)).Perm(total)
+	// inserts every key then deletes half of them on the same tree, an operation failing on
+	// a write back has changed nothing and succeeds when it is retried
+	workload := func(tr *btreeCursor) (failed int) {
+		for _, key := range keys {
+			item := int64(key + 1)
+			if err := tr.insert(keyT{main: item}, item); err != nil {
+				assert.ErrorIs(t, err, buff.ErrInjectedFault)
+				failed++
+				assert.NoError(t, tr.insert(keyT{main: item}, item))
+			}
+		}
+		for _, key := range keys[:total/2] {
+			item := int64(key + 1)
+			if err := tr.delete(keyT{main: item}); err != nil {
+				assert.ErrorIs(t, err, buff.ErrInjectedFault)
+				failed++
+				assert.NoError(t, tr.delete(keyT{main: item}))
+			}
+		}
+		return failed
+	}
+	dryRun := newFaultDisk(t, seed)
+	tr, err := NewBtreeOnDisk(dryRun, nodeSize, WithPoolSize(16))
+	assert.NoError(t, err)
+	created := dryRun.Writes()
+	assert.Zero(t, workload(tr))
+	writes := dryRun.Writes() - created
+
+	deleted := map[int64]bool{}
+	for _, key := range keys[:total/2] {
+		deleted[int64(key+1)] = true
+	}
+	var want []int64
+	for _, item := range sequentialUntil(total) {
+		if !deleted[item] {
+			want = append(want, item)
+		}
+	}
+	for n := 1; n <= writes; n += 3 {
+		disk := newFaultDisk(t, seed)
+		tr, err := NewBtreeOnDisk(disk, nodeSize, WithPoolSize(16))
+		assert.NoError(t, err)
+		disk.FailWrite(n)
+		assert.Equal(t, 1, workload(tr), "write %d", n)
+		assert.Equal(t, want, scanKeys(t, tr), "write %d", n)
+		assert.NoError(t, tr.Close(), "write %d", n)
+	}
+}
+
+func Test_btreeRootChangeSurvivesWriteFaults(t *testing.T) {
+	disk := newFaultDisk(t, 7)
+	tr, err := NewBtreeOnDisk(disk, crashNodeSize, WithPoolSize(100))
+	assert.NoError(t, err)
+	// root splits change the header, the pool is large enough for nothing to be written back
+	disk.FailWrite(1)
+	for _, item := range sequentialUntil(100) {
+		assert.NoError(t, tr.insert(keyT{main: item}, item))
+	}
+	assert.Greater(t, tr._header.rootPgid, nodeID(1))
+	assert.ErrorIs(t, tr.Sync(), buff.ErrInjectedFault)
+	assert.NoError(t, tr.Sync())
+
+	tr = reopenAfterCrash(t, disk)
+	assert.Equal(t, sequentialUntil(100), scanKeys(t, tr))
+	assert.NoError(t, tr.Close())
+}
+
+func Test_btreeReportsTornNodes(t *testing.T) {
+	disk := newFaultDisk(t, 5)
+	tr, err := NewBtreeOnDisk(disk, crashNodeSize)
+	assert.NoError(t, err)
+	for _, item := range sequentialUntil(3) {
+		assert.NoError(t, tr.insert(keyT{main: item}, item))
+	}
+	rootPgid := tr._header.rootPgid
+	assert.NoError(t, tr.Close())
+
+	// the root leaf is half overwritten with garbage
+	garbage := make([]byte, buff.DefaultPageSize)
+	for i := range garbage {
+		garbage[i] = 0xff
+	}
+	disk.TearWrite(1)
+	assert.ErrorIs(t, disk.WritePage(int64(rootPgid), garbage), buff.ErrInjectedFault)
+
+	tr, err = NewBtreeOnDisk(disk, crashNodeSize)
+	assert.NoError(t, err)
+	var corrupt *buff.CorruptPageError
+	assert.True(t, errors.As(tr.insert(keyT{main: 4}, 4), &corrupt))
+	assert.Equal(t, int(rootPgid), corrupt.PageID)
+	assert.True(t, errors.As(tr.delete(keyT{main: 1}), &corrupt))
+	assert.NoError(t, tr.Close())
+}
+
+func Test_NewBtreeRejectsOversizedNodes(t *testing.T) {
+	for _, pageSize := range []int{buff.DefaultPageSize, 16 << 10} {
+		limit := maxNodeSize(pageSize - 4)
+		_, err := NewBtreeOnDisk(newMemDisk(t, buff.WithPageSize(pageSize)), limit+1)
+		assert.Error(t, err)
+		tr, err := NewBtreeOnDisk(newMemDisk(t, buff.WithPageSize(pageSize)), limit)
+		assert.NoError(t, err)
+		assert.Equal(t, pageSize-4, tr.bpm.PageDataSize())
+		for _, item := range sequentialUntil(limit * 3) {
+			assert.NoError(t, tr.insert(keyT{main: item}, item))
+		}
+		assert.Equal(t, sequentialUntil(limit*3), scanKeys(t, tr))
+		assert.NoError(t, tr.Close())
+	}
+}
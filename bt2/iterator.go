@@ -0,0 +1,354 @@
+package bt2
+
+import "math"
+
+// bounds is a half open key range [start, end), a missing bound is unlimited
+type bounds struct {
+	start, end       int64
+	hasStart, hasEnd bool
+}
+
+// Iterator walks the keys of a Tree within its bounds, in ascending order with Next
+// and in descending order with Prev:
+//
+//	it := tr.Range(10, 20)
+//	defer it.Close()
+//	for it.Next() {
+//		use(it.Key(), it.Value())
+//	}
+//	return it.Err()
+//
+// It follows the sibling links between leaves in both directions and keeps only the leaf
+// it is positioned on pinned. The leaf is only read latched during a step, between steps the
+// iterator keeps a copy of its key and value, and the next step goes on from that key, from
+// the root again if the leaf has been merged away or has lost the keys next to it meanwhile.
+// The goroutine iterating may thus use the tree between steps, modifications included.
+// Keys inserted or deleted during the scan may or may not be seen
+type Iterator struct {
+	tree   *Tree
+	bounds bounds
+	// pinned, nil if the iterator is not positioned on a key
+	leaf *genericNode
+	// leaf is read latched, only during a step
+	latched bool
+	// slot of the key in leaf, valid while it is latched
+	idx int
+	// copied from leaf when a step ends
+	key, val int64
+	started  bool
+	err      error
+}
+
+// Scan returns an iterator over every key of the tree
+func (t *Tree) Scan() *Iterator {
+	return &Iterator{tree: t}
+}
+
+// Range returns an iterator over the keys in [start, end)
+func (t *Tree) Range(start, end int64) *Iterator {
+	return &Iterator{tree: t, bounds: bounds{start: start, end: end, hasStart: true, hasEnd: true}}
+}
+
+// Prefix returns an iterator over the keys whose bits above the lowest shift bits are prefix,
+// i.e. key>>shift == prefix. With keys built as tenant<<32|id, Prefix(tenant, 32) scans a tenant
+func (t *Tree) Prefix(prefix int64, shift uint) *Iterator {
+	// no int64 key has this prefix
+	empty := &Iterator{tree: t, bounds: bounds{hasStart: true, hasEnd: true}}
+	if shift >= 63 {
+		// only the sign bit is left, key>>shift is 0 for the non-negative keys and -1 for the others
+		switch prefix {
+		case 0:
+			return &Iterator{tree: t, bounds: bounds{start: 0, hasStart: true}}
+		case -1:
+			return &Iterator{tree: t, bounds: bounds{end: 0, hasEnd: true}}
+		}
+		return empty
+	}
+	start := prefix << shift
+	if start>>shift != prefix {
+		return empty
+	}
+	b := bounds{start: start, hasStart: true}
+	if end := (prefix + 1) << shift; prefix < math.MaxInt64 && end>>shift == prefix+1 {
+		b.end, b.hasEnd = end, true
+	}
+	return &Iterator{tree: t, bounds: b}
+}
+
+// SeekGE positions the iterator on the first key at or after key within the bounds,
+// it returns false if there is none. It is the Seek of other iterators, go vet reserves
+// that name for io.Seeker
+func (it *Iterator) SeekGE(key int64) bool {
+	if it.err != nil {
+		return false
+	}
+	if it.bounds.hasStart && key < it.bounds.start {
+		key = it.bounds.start
+	}
+	if !it.seek(keyT{main: key}) {
+		return false
+	}
+	return it.park(it.settle())
+}
+
+// SeekLT positions the iterator on the last key before key within the bounds,
+// it returns false if there is none. SeekLT followed by Prev scans the keys before key
+func (it *Iterator) SeekLT(key int64) bool {
+	if it.err != nil {
+		return false
+	}
+	if it.bounds.hasEnd && key > it.bounds.end {
+		key = it.bounds.end
+	}
+	return it.park(it.seekBefore(keyT{main: key}))
+}
+
+// SeekLast positions the iterator on the last key within the bounds,
+// it returns false if there is none
+func (it *Iterator) SeekLast() bool {
+	if it.err != nil {
+		return false
+	}
+	if it.bounds.hasEnd {
+		return it.park(it.seekBefore(keyT{main: it.bounds.end}))
+	}
+	// greater than any key the tree stores
+	return it.park(it.seekBefore(keyT{main: math.MaxInt64, sub: math.MaxInt64}))
+}
+
+// seekBefore positions the iterator on the last key before key
+func (it *Iterator) seekBefore(key keyT) bool {
+	if !it.seek(key) {
+		return false
+	}
+	it.idx--
+	return it.settleBack()
+}
+
+// seek latches the leaf that holds key, idx is the slot of the first key at or after key
+func (it *Iterator) seek(key keyT) bool {
+	it.release()
+	it.started = true
+	c := it.tree.cursor
+	leaf, err := c.searchLeafRead(key)
+	if err != nil {
+		return it.fail(err)
+	}
+	it.leaf, it.latched = leaf, true
+	it.idx, _ = c.leafNodeFindKeySlot(leaf, key)
+	return true
+}
+
+// Next moves to the next key, the first call on an iterator that has not been
+// positioned moves to the first key within the bounds
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if !it.started {
+		if it.bounds.hasStart {
+			return it.SeekGE(it.bounds.start)
+		}
+		return it.SeekGE(math.MinInt64)
+	}
+	if it.leaf == nil {
+		return false
+	}
+	return it.park(it.resume(true))
+}
+
+// Prev moves to the previous key, the first call on an iterator that has not been
+// positioned moves to the last key within the bounds
+func (it *Iterator) Prev() bool {
+	if it.err != nil {
+		return false
+	}
+	if !it.started {
+		return it.SeekLast()
+	}
+	if it.leaf == nil {
+		return false
+	}
+	return it.park(it.resume(false))
+}
+
+// resume latches the leaf again and moves to the key after the copied one, or before it
+// if forward is not set. The leaf pinned by the iterator cannot be deleted, but it may have
+// been merged away, or split, or its keys may have moved to its siblings. It is only used
+// while the copied key is within its first and last keys, every key of the leaves before
+// it is less and every key of the leaves after it is greater. Else the iterator
+// descends from the root again
+func (it *Iterator) resume(forward bool) bool {
+	c := it.tree.cursor
+	leaf := it.leaf
+	leaf.mu.RLock()
+	it.latched = true
+	key := keyT{main: it.key}
+	if !leaf.isDeleted && leaf.isLeafNode && leaf.size > 0 &&
+		compareKey(leaf.datas[0].key, key) <= 0 && compareKey(leaf.datas[leaf.size-1].key, key) >= 0 {
+		idx, exact := c.leafNodeFindKeySlot(leaf, key)
+		if !forward {
+			it.idx = idx - 1
+			return it.settleBack()
+		}
+		if exact {
+			idx++
+		}
+		it.idx = idx
+		return it.settle()
+	}
+	if !forward {
+		return it.seekBefore(key)
+	}
+	if !it.seek(key) {
+		return false
+	}
+	if it.idx < int(it.leaf.size) && compareKey(it.leaf.datas[it.idx].key, key) == 0 {
+		it.idx++
+	}
+	return it.settle()
+}
+
+// park copies the key and value the iterator is positioned on and gives back the read
+// latch of the leaf, which stays pinned, ok is the outcome of the step
+func (it *Iterator) park(ok bool) bool {
+	if !ok {
+		return false
+	}
+	item := it.leaf.datas[it.idx]
+	it.key, it.val = item.key.main, item.val.main
+	it.leaf.mu.RUnlock()
+	it.latched = false
+	return true
+}
+
+// settle moves past the end of exhausted leaves and checks the upper bound
+func (it *Iterator) settle() bool {
+	for it.idx >= int(it.leaf.size) {
+		if !it.moveNext() {
+			return false
+		}
+		it.idx = 0
+	}
+	if it.bounds.hasEnd && it.leaf.datas[it.idx].key.main >= it.bounds.end {
+		it.release()
+		return false
+	}
+	return true
+}
+
+// settleBack moves before the start of exhausted leaves and checks the lower bound
+func (it *Iterator) settleBack() bool {
+	for it.idx < 0 {
+		if !it.movePrev() {
+			return false
+		}
+	}
+	if it.bounds.hasStart && it.leaf.datas[it.idx].key.main < it.bounds.start {
+		it.release()
+		return false
+	}
+	return true
+}
+
+// moveNext latches the next leaf before releasing the current one,
+// it returns false at the end of the leaf chain
+func (it *Iterator) moveNext() bool {
+	next := it.leaf.next
+	if next == 0 || next == invalidID {
+		it.release()
+		return false
+	}
+	c := it.tree.cursor
+	leaf, err := c.getGenericNode(next)
+	if err != nil {
+		return it.fail(err)
+	}
+	leaf.mu.RLock()
+	c.releaseRead(it.leaf)
+	it.leaf = leaf
+	return true
+}
+
+// movePrev moves to the last key of the previous leaf, it returns false at the start of the
+// leaf chain. Writers latch leaves from left to right, waiting for the latch of the previous
+// leaf while holding the current one could deadlock. The previous leaf is pinned while the
+// current one is latched, which keeps it from being deleted, and latched once the current
+// one is released. If it has been split or merged away meanwhile, the iterator descends
+// from the root again
+func (it *Iterator) movePrev() bool {
+	prev := it.leaf.prev
+	if prev == 0 || prev == invalidID {
+		it.release()
+		return false
+	}
+	c := it.tree.cursor
+	cur := nodeID(it.leaf.osPage.GetPageID())
+	// leaves other than the root are never empty
+	before := it.leaf.datas[0].key
+	leaf, err := c.getGenericNode(prev)
+	if err != nil {
+		return it.fail(err)
+	}
+	c.releaseRead(it.leaf)
+	it.leaf, it.latched = nil, false
+	leaf.mu.RLock()
+	if leaf.isDeleted || !leaf.isLeafNode || leaf.next != cur {
+		c.releaseRead(leaf)
+		return it.seekBefore(before)
+	}
+	// keys at or after before may have moved into it meanwhile
+	idx, _ := c.leafNodeFindKeySlot(leaf, before)
+	if idx == 0 {
+		c.releaseRead(leaf)
+		return it.seekBefore(before)
+	}
+	it.leaf, it.latched, it.idx = leaf, true, idx-1
+	return true
+}
+
+// Key returns the key the iterator is positioned on, 0 if it is not positioned
+func (it *Iterator) Key() int64 {
+	if it.leaf == nil {
+		return 0
+	}
+	return it.key
+}
+
+// Value returns the value stored with Key, 0 if the iterator is not positioned
+func (it *Iterator) Value() int64 {
+	if it.leaf == nil {
+		return 0
+	}
+	return it.val
+}
+
+// Err returns the error that stopped the iteration, if any
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the leaf pinned by the iterator and returns Err,
+// it can be called more than once
+func (it *Iterator) Close() error {
+	it.release()
+	return it.err
+}
+
+func (it *Iterator) fail(err error) bool {
+	it.err = err
+	it.release()
+	return false
+}
+
+func (it *Iterator) release() {
+	if it.leaf == nil {
+		return
+	}
+	if it.latched {
+		it.tree.cursor.releaseRead(it.leaf)
+	} else {
+		it.tree.cursor.bpm.UnpinPage(it.leaf.osPage.GetPageID(), false)
+	}
+	it.leaf, it.latched = nil, false
+}
@@ -0,0 +1,289 @@
+package bt2
+
+import (
+	"buff"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func collect(t *testing.T, it *Iterator) []int64 {
+	var keys []int64
+	for it.Next() {
+		assert.Equal(t, it.Key()*10, it.Value())
+		keys = append(keys, it.Key())
+	}
+	assert.NoError(t, it.Close())
+	return keys
+}
+
+func collectBackward(t *testing.T, it *Iterator) []int64 {
+	var keys []int64
+	for it.Prev() {
+		assert.Equal(t, it.Key()*10, it.Value())
+		keys = append(keys, it.Key())
+	}
+	assert.NoError(t, it.Close())
+	return keys
+}
+
+func reversed(keys []int64) []int64 {
+	r := make([]int64, 0, len(keys))
+	for i := len(keys) - 1; i >= 0; i-- {
+		r = append(r, keys[i])
+	}
+	return r
+}
+
+func newTestTree(t *testing.T, keys []int64) *Tree {
+	tr, err := OpenOnDisk(newMemDisk(t), WithNodeSize(crashNodeSize), WithPoolSize(16))
+	assert.NoError(t, err)
+	for _, key := range keys {
+		assert.NoError(t, tr.Insert(key, key*10))
+	}
+	return tr
+}
+
+func Test_IteratorRanges(t *testing.T) {
+	tr := newTestTree(t, nil)
+	assert.Empty(t, collect(t, tr.Scan()))
+
+	var keys []int64
+	for key := int64(-100); key < 300; key += 2 {
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		assert.NoError(t, tr.Insert(key, key*10))
+	}
+	assert.Equal(t, keys, collect(t, tr.Scan()))
+	assert.Equal(t, []int64{10, 12, 14, 16, 18}, collect(t, tr.Range(9, 20)))
+	assert.Empty(t, collect(t, tr.Range(20, 20)))
+	assert.Empty(t, collect(t, tr.Range(1000, 2000)))
+
+	// seek inside the bounds, before them and past the last key
+	it := tr.Range(0, 100)
+	assert.True(t, it.SeekGE(51))
+	assert.Equal(t, int64(52), it.Key())
+	assert.True(t, it.Next())
+	assert.Equal(t, int64(54), it.Key())
+	assert.True(t, it.SeekGE(-50))
+	assert.Equal(t, int64(0), it.Key())
+	assert.False(t, it.SeekGE(100))
+	assert.False(t, it.Next())
+	assert.NoError(t, it.Close())
+
+	// the tree can be modified once the iterator is closed
+	assert.NoError(t, tr.Insert(1, 10))
+	assert.NoError(t, tr.Close())
+}
+
+func Test_IteratorPrefix(t *testing.T) {
+	var keys []int64
+	for tenant := int64(-2); tenant <= 2; tenant++ {
+		for id := int64(0); id < 40; id++ {
+			keys = append(keys, tenant<<32|id)
+		}
+	}
+	tr := newTestTree(t, keys)
+	for i, tenant := 0, int64(-2); tenant <= 2; i, tenant = i+1, tenant+1 {
+		assert.Equal(t, keys[i*40:(i+1)*40], collect(t, tr.Prefix(tenant, 32)))
+	}
+	assert.Empty(t, collect(t, tr.Prefix(3, 32)))
+	assert.Equal(t, keys[80:], collect(t, tr.Prefix(0, 62)))
+	// only the sign bit is left above 63 bits
+	assert.Empty(t, collect(t, tr.Prefix(5, 63)))
+	assert.Equal(t, keys[80:], collect(t, tr.Prefix(0, 63)))
+	assert.Equal(t, keys[:80], collect(t, tr.Prefix(-1, 63)))
+	assert.Equal(t, keys[:80], collect(t, tr.Prefix(-1, 64)))
+	assert.NoError(t, tr.Close())
+}
+
+func Test_IteratorPinsOneLeaf(t *testing.T) {
+	tr := newTestTree(t, sequentialUntil(200))
+	it := tr.Scan()
+	n := 0
+	for it.Next() {
+		pinned := 0
+		for _, f := range ownPool(tr.cursor).Frames() {
+			if f.PageID > 0 && f.PinCount > 0 {
+				pinned++
+			}
+		}
+		assert.Equal(t, 1, pinned)
+		n++
+	}
+	assert.NoError(t, it.Close())
+	assert.Equal(t, 200, n)
+	assert.NoError(t, tr.Close())
+}
+
+func Test_IteratorReportsReadErrors(t *testing.T) {
+	disk := newFaultDisk(t, 1)
+	tr, err := OpenOnDisk(disk, WithNodeSize(crashNodeSize), WithPoolSize(16))
+	assert.NoError(t, err)
+	for _, key := range sequentialUntil(200) {
+		assert.NoError(t, tr.Insert(key, key*10))
+	}
+	// leaves have been evicted, the scan reads them back
+	it := tr.Scan()
+	assert.True(t, it.Next())
+	disk.FailRead(1)
+	for it.Next() {
+	}
+	assert.ErrorIs(t, it.Err(), buff.ErrInjectedFault)
+	assert.ErrorIs(t, it.Close(), buff.ErrInjectedFault)
+	assert.False(t, it.Next())
+	assert.Equal(t, sequentialUntil(200), collect(t, tr.Scan()))
+	assert.NoError(t, tr.Close())
+}
+
+// leafChain returns the leaves in key order following next links and the leaves in
+// reverse key order following prev links
+func leafChain(t *testing.T, tr *Tree) (forward, backward []int64) {
+	c := tr.cursor
+	leaf, err := c.searchLeafRead(keyT{main: math.MinInt64, sub: math.MinInt64})
+	assert.NoError(t, err)
+	for {
+		forward = append(forward, int64(leaf.osPage.GetPageID()))
+		next := leaf.next
+		c.releaseRead(leaf)
+		if next == 0 {
+			break
+		}
+		leaf, err = c.getGenericNode(next)
+		assert.NoError(t, err)
+		leaf.mu.RLock()
+	}
+	// a broken chain may have cycles
+	for id := nodeID(forward[len(forward)-1]); id != 0 && len(backward) <= len(forward); {
+		backward = append(backward, int64(id))
+		leaf, err := c.getGenericNode(id)
+		assert.NoError(t, err)
+		id = leaf.prev
+		c.bpm.UnpinPage(leaf.osPage.GetPageID(), false)
+	}
+	return forward, backward
+}
+
+func Test_LeafPrevLinks(t *testing.T) {
+	tr := newTestTree(t, nil)
+	r := rand.New(rand.NewSource(1))
+	live := map[int64]bool{}
+	for i := 0; i < 2000; i++ {
+		key := r.Int63n(400)
+		if live[key] {
+			assert.NoError(t, tr.Delete(key))
+			delete(live, key)
+		} else {
+			assert.NoError(t, tr.Insert(key, key*10))
+			live[key] = true
+		}
+		if i%100 == 0 {
+			forward, backward := leafChain(t, tr)
+			assert.Equal(t, reversed(forward), backward)
+		}
+	}
+	forward, backward := leafChain(t, tr)
+	assert.Equal(t, reversed(forward), backward)
+	assert.Greater(t, len(forward), 10)
+	assert.NoError(t, tr.Close())
+}
+
+func Test_IteratorReverse(t *testing.T) {
+	tr := newTestTree(t, nil)
+	assert.Empty(t, collectBackward(t, tr.Scan()))
+
+	var keys []int64
+	for key := int64(-100); key < 300; key += 2 {
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		assert.NoError(t, tr.Insert(key, key*10))
+	}
+	assert.Equal(t, reversed(keys), collectBackward(t, tr.Scan()))
+	assert.Equal(t, []int64{18, 16, 14, 12, 10}, collectBackward(t, tr.Range(9, 20)))
+	assert.Equal(t, []int64{18, 16, 14, 12, 10}, collectBackward(t, tr.Range(10, 19)))
+	assert.Empty(t, collectBackward(t, tr.Range(20, 20)))
+	assert.Empty(t, collectBackward(t, tr.Range(-2000, -1000)))
+
+	// the latest three keys before 51
+	it := tr.Scan()
+	var latest []int64
+	for ok := it.SeekLT(51); ok && len(latest) < 3; ok = it.Prev() {
+		latest = append(latest, it.Key())
+	}
+	assert.Equal(t, []int64{50, 48, 46}, latest)
+	assert.False(t, it.SeekLT(-100))
+	assert.NoError(t, it.Close())
+
+	// change direction in the middle of a scan and across leaves
+	it = tr.Range(0, 100)
+	assert.True(t, it.SeekLast())
+	assert.Equal(t, int64(98), it.Key())
+	assert.True(t, it.SeekLT(1000))
+	assert.Equal(t, int64(98), it.Key())
+	for i := 0; i < 20; i++ {
+		assert.True(t, it.Prev())
+	}
+	assert.Equal(t, int64(58), it.Key())
+	for i := 0; i < 10; i++ {
+		assert.True(t, it.Next())
+	}
+	assert.Equal(t, int64(78), it.Key())
+	assert.True(t, it.SeekGE(1))
+	assert.True(t, it.Prev())
+	assert.Equal(t, int64(0), it.Key())
+	assert.False(t, it.Prev())
+	assert.NoError(t, it.Close())
+
+	pinned := 0
+	for _, f := range ownPool(tr.cursor).Frames() {
+		if f.PageID > 0 && f.PinCount > 0 {
+			pinned++
+		}
+	}
+	assert.Equal(t, 0, pinned)
+	assert.NoError(t, tr.Close())
+}
+
+func Test_IteratorAllowsTreeCallsBetweenSteps(t *testing.T) {
+	keys := sequentialUntil(300)
+	tr := newTestTree(t, keys)
+	// every step deletes the key it is on, which merges the leaves behind and under the
+	// iterator, and inserts keys before it, which splits them
+	var seen []int64
+	it := tr.Scan()
+	for it.Next() {
+		key := it.Key()
+		seen = append(seen, key)
+		assert.NoError(t, tr.Delete(key))
+		assert.NoError(t, tr.Insert(-key, -key*10))
+		if val, err := tr.Get(key + 1); err == nil {
+			assert.Equal(t, (key+1)*10, val)
+		}
+		assert.Equal(t, []int64{-key}, collect(t, tr.Range(-key, -key+1)))
+	}
+	assert.NoError(t, it.Close())
+	assert.Equal(t, keys, seen)
+
+	// and backwards over the negative keys, inserting behind the iterator again
+	var want, rest []int64
+	seen = nil
+	it = tr.Scan()
+	for it.Prev() {
+		key := it.Key()
+		seen = append(seen, key)
+		assert.NoError(t, tr.Delete(key))
+		assert.NoError(t, tr.Insert(key+1000, (key+1000)*10))
+	}
+	assert.NoError(t, it.Close())
+	for _, key := range keys {
+		want = append(want, -key)
+		rest = append(rest, 1000-key)
+	}
+	assert.Equal(t, want, seen)
+	assert.Equal(t, reversed(rest), collect(t, tr.Scan()))
+	assert.NoError(t, tr.Close())
+}
@@ -0,0 +1,66 @@
+package bt2
+
+import (
+	"buff"
+	"errors"
+)
+
+var (
+	// ErrKeyExists is returned by Insert when the key is already in the tree
+	ErrKeyExists = errors.New("key already exists")
+	// ErrNotFound is returned by Get and Delete when the key is not in the tree
+	ErrNotFound = errors.New("key not found")
+)
+
+// Tree is a B+tree mapping int64 keys to int64 values, stored in the pages of a buffer pool.
+// It is safe for concurrent use, operations latch the nodes they visit rather than the whole
+// tree, so that lookups, scans and modifications of different leaves run in parallel
+type Tree struct {
+	cursor *btreeCursor
+}
+
+// Open opens or creates the tree stored in the file at path, path must be empty
+// if the tree is opened WithBufferPool
+func Open(path string, opts ...Option) (*Tree, error) {
+	cursor, err := NewBtree(path, newTreeConfig(opts).nodeSize, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Tree{cursor: cursor}, nil
+}
+
+// OpenOnDisk opens or creates a tree on any storage backend, the tree owns disk
+// afterwards and closes it in Close
+func OpenOnDisk(disk buff.DiskManager, opts ...Option) (*Tree, error) {
+	cursor, err := NewBtreeOnDisk(disk, newTreeConfig(opts).nodeSize, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Tree{cursor: cursor}, nil
+}
+
+// Insert adds key with value, it returns ErrKeyExists if key is already in the tree
+func (t *Tree) Insert(key, value int64) error {
+	return t.cursor.insert(keyT{main: key}, value)
+}
+
+// Delete removes key, it returns ErrNotFound if key is not in the tree
+func (t *Tree) Delete(key int64) error {
+	return t.cursor.delete(keyT{main: key})
+}
+
+// Get returns the value stored with key, or ErrNotFound
+func (t *Tree) Get(key int64) (int64, error) {
+	return t.cursor.get(keyT{main: key})
+}
+
+// Sync makes every change done so far durable
+func (t *Tree) Sync() error {
+	return t.cursor.Sync()
+}
+
+// Close flushes the tree to disk, the tree cannot be used afterwards.
+// It must not be called while other operations or iterators are in progress
+func (t *Tree) Close() error {
+	return t.cursor.Close()
+}
@@ -0,0 +1,219 @@
+package bt2
+
+import (
+	"buff"
+	"math/rand"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_TreeOpen(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.db")
+	tr, err := Open(file)
+	assert.NoError(t, err)
+	assert.Equal(t, maxNodeSize(tr.cursor.bpm.PageDataSize()), tr.cursor._header.nodeSize)
+	for _, key := range sequentialUntil(1000) {
+		assert.NoError(t, tr.Insert(key, key*10))
+	}
+	assert.ErrorIs(t, tr.Insert(7, 0), ErrKeyExists)
+	assert.NoError(t, tr.Delete(7))
+	assert.ErrorIs(t, tr.Delete(7), ErrNotFound)
+	_, err = tr.Get(7)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.NoError(t, tr.Close())
+
+	// the node size of an existing tree wins
+	tr, err = Open(file, WithNodeSize(5), WithPoolSize(8))
+	assert.NoError(t, err)
+	assert.Equal(t, maxNodeSize(tr.cursor.bpm.PageDataSize()), tr.cursor._header.nodeSize)
+	for _, key := range sequentialUntil(1000) {
+		val, err := tr.Get(key)
+		if key == 7 {
+			assert.ErrorIs(t, err, ErrNotFound)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, key*10, val)
+	}
+	assert.NoError(t, tr.Close())
+
+	_, err = OpenOnDisk(newMemDisk(t), WithNodeSize(2))
+	assert.Error(t, err)
+}
+
+func Test_TreeRandomOps(t *testing.T) {
+	// even node sizes used to fill up merged branch nodes
+	for _, nodeSize := range []int64{3, 4, 5, 6, 8} {
+		tr, err := OpenOnDisk(newMemDisk(t), WithNodeSize(nodeSize))
+		assert.NoError(t, err)
+		rnd := rand.New(rand.NewSource(nodeSize))
+		expect := map[int64]int64{}
+		for i := 0; i < 3000; i++ {
+			key := rnd.Int63n(500)
+			_, exists := expect[key]
+			if rnd.Intn(3) == 0 {
+				err := tr.Delete(key)
+				if exists {
+					assert.NoError(t, err)
+					delete(expect, key)
+				} else {
+					assert.ErrorIs(t, err, ErrNotFound)
+				}
+				continue
+			}
+			err := tr.Insert(key, int64(i))
+			if exists {
+				assert.ErrorIs(t, err, ErrKeyExists)
+			} else {
+				assert.NoError(t, err)
+				expect[key] = int64(i)
+			}
+		}
+		for key := int64(0); key < 500; key++ {
+			val, err := tr.Get(key)
+			if expectVal, ok := expect[key]; ok {
+				assert.NoError(t, err)
+				assert.Equal(t, expectVal, val)
+			} else {
+				assert.ErrorIs(t, err, ErrNotFound)
+			}
+		}
+		assert.Len(t, scanKeys(t, tr.cursor), len(expect))
+		assert.NoError(t, tr.Close())
+	}
+}
+
+// assertOrdered checks that keys are strictly ascending, or descending if desc is set
+func assertOrdered(t *testing.T, keys []int64, desc bool) {
+	for i := 1; i < len(keys); i++ {
+		if desc {
+			assert.Greater(t, keys[i-1], keys[i])
+		} else {
+			assert.Less(t, keys[i-1], keys[i])
+		}
+	}
+}
+
+func Test_TreeConcurrentStress(t *testing.T) {
+	const (
+		writers = 4
+		keys    = 400
+		ops     = 800
+	)
+	for _, nodeSize := range []int64{4, crashNodeSize} {
+		tr, err := OpenOnDisk(newMemDisk(t), WithNodeSize(nodeSize), WithPoolSize(256))
+		assert.NoError(t, err)
+		// every writer owns the keys equal to its number modulo writers
+		expect := make([]map[int64]bool, writers)
+		var wg sync.WaitGroup
+		done := make(chan struct{})
+		for w := 0; w < writers; w++ {
+			expect[w] = map[int64]bool{}
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				rnd := rand.New(rand.NewSource(nodeSize*writers + int64(w)))
+				live := expect[w]
+				for i := 0; i < ops; i++ {
+					key := rnd.Int63n(keys/writers)*writers + int64(w)
+					if live[key] {
+						assert.NoError(t, tr.Delete(key))
+						delete(live, key)
+					} else {
+						assert.NoError(t, tr.Insert(key, key*10))
+						live[key] = true
+					}
+				}
+			}(w)
+		}
+		var readers sync.WaitGroup
+		for r := 0; r < 3; r++ {
+			readers.Add(1)
+			go func(r int) {
+				defer readers.Done()
+				rnd := rand.New(rand.NewSource(int64(r)))
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					switch r {
+					case 0:
+						key := rnd.Int63n(keys)
+						if val, err := tr.Get(key); err == nil {
+							assert.Equal(t, key*10, val)
+						} else {
+							assert.ErrorIs(t, err, ErrNotFound)
+						}
+					case 1:
+						start := rnd.Int63n(keys)
+						assertOrdered(t, collect(t, tr.Range(start, start+100)), false)
+					case 2:
+						assertOrdered(t, collectBackward(t, tr.Scan()), true)
+					}
+				}
+			}(r)
+		}
+		wg.Wait()
+		close(done)
+		readers.Wait()
+
+		var want []int64
+		for key := int64(0); key < keys; key++ {
+			if expect[key%writers][key] {
+				want = append(want, key)
+			}
+		}
+		assert.Equal(t, want, collect(t, tr.Scan()))
+		assert.Equal(t, reversed(want), collectBackward(t, tr.Scan()))
+		forward, backward := leafChain(t, tr)
+		assert.Equal(t, reversed(forward), backward)
+		for _, f := range ownPool(tr.cursor).Frames() {
+			if f.PageID > 0 {
+				assert.Zero(t, f.PinCount)
+			}
+		}
+		assert.NoError(t, tr.Close())
+	}
+}
+
+func Test_TreeOnParallelBufferPool(t *testing.T) {
+	const (
+		writers = 4
+		keys    = 1000
+	)
+	bpm := buff.NewParallelBufferPool(4, 16, newMemDisk(t))
+	tr, err := Open("", WithBufferPool(bpm), WithNodeSize(crashNodeSize))
+	assert.NoError(t, err)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for key := int64(w); key < keys; key += writers {
+				assert.NoError(t, tr.Insert(key, key*10))
+			}
+			// deletions merge the leaves of the other writers as well
+			for key := int64(w); key < keys; key += 2 * writers {
+				assert.NoError(t, tr.Delete(key))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	var want []int64
+	for key := int64(0); key < keys; key++ {
+		if key%(2*writers) >= writers {
+			want = append(want, key)
+		}
+	}
+	assert.Equal(t, want, collect(t, tr.Scan()))
+	assert.Equal(t, reversed(want), collectBackward(t, tr.Scan()))
+	assert.NoError(t, tr.Close())
+	// closing the pool checks that the tree left nothing pinned
+	assert.NoError(t, bpm.Close())
+}
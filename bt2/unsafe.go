@@ -10,6 +10,21 @@ func castHeaderPage(sl []byte) *headerPage {
 	return h
 }
 
+// maxNodeSize is the largest node size whose leaf and branch nodes fit in
+// pageDataSize, the part of a page that the buffer pool leaves to its users
+func maxNodeSize(pageDataSize int) int64 {
+	dataSize := int64(pageDataSize)
+	fixed := int64(unsafe.Sizeof(pageHeader{}))
+	leaf := (dataSize - fixed) / int64(unsafe.Sizeof(valT{}))
+	// a branch has one more child than keys
+	branch := (dataSize - fixed - int64(unsafe.Sizeof(nodeID(0)))) /
+		int64(unsafe.Sizeof(keyT{})+unsafe.Sizeof(nodeID(0)))
+	if leaf < branch {
+		return leaf
+	}
+	return branch
+}
+
 // pageData is mmap
 func castLeafFromEmpty(nodeSize int, page Page) *genericNode {
 	pageData := page.GetData()
@@ -115,7 +130,9 @@ type pageHeader struct {
 	_padding2  [6]byte
 	level      int64
 	size       int64
-	next       nodeID
+	// sibling leaves, 0 if there is none
+	next nodeID
+	prev nodeID
 }
 type genericNode struct {
 	mu     *sync.RWMutex
@@ -147,6 +164,8 @@ type nodeID int64
 const (
 	//TODO more flag
 	headerFlagInit int64 = 1 << iota
+	// leaves have prev links, trees created before them have a smaller page header
+	headerFlagLeafPrev
 
 	invalidID nodeID = -1
 )
@@ -4,6 +4,7 @@ import (
 	"buff"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -15,8 +16,8 @@ func Test_castLeafPage(t *testing.T) {
 		nodeSize int    = 10
 		next     nodeID = 7
 	)
-	testFile := "./testdb"
-	somePage := make([]byte, buff.PageSize)
+	testFile := filepath.Join(t.TempDir(), "testdb")
+	somePage := make([]byte, buff.DefaultPageSize)
 	h := castLeafFromEmpty(nodeSize, newMockPage(somePage))
 	h.size = size
 	h.next = next
@@ -30,13 +31,12 @@ func Test_castLeafPage(t *testing.T) {
 	}
 	// h.children
 	assert.NoError(t, os.WriteFile(testFile, somePage, os.ModePerm))
-	defer os.Remove(testFile)
 	file, err := os.OpenFile(testFile, os.O_RDONLY, os.ModePerm)
 	assert.NoError(t, err)
-	newBuf := make([]byte, buff.PageSize)
+	newBuf := make([]byte, buff.DefaultPageSize)
 	n, err := file.Read(newBuf)
 	assert.NoError(t, err)
-	assert.Equal(t, buff.PageSize, n)
+	assert.Equal(t, buff.DefaultPageSize, n)
 
 	h2 := castGenericNode(nodeSize, newMockPage(newBuf))
 	assert.Equal(t, nodeSize, len(h2.datas))
@@ -50,8 +50,8 @@ func Test_castLeafPage(t *testing.T) {
 }
 
 func Test_castBranchPage(t *testing.T) {
-	testFile := "./testdb"
-	somePage := make([]byte, buff.PageSize)
+	testFile := filepath.Join(t.TempDir(), "testdb")
+	somePage := make([]byte, buff.DefaultPageSize)
 	h := castBranchFromEmpty(10, newMockPage(somePage))
 	h.size = 9
 	assert.Len(t, h.keys, 10)
@@ -63,13 +63,12 @@ func Test_castBranchPage(t *testing.T) {
 	}
 	// h.children
 	assert.NoError(t, os.WriteFile(testFile, somePage, os.ModePerm))
-	defer os.Remove(testFile)
 	file, err := os.OpenFile(testFile, os.O_RDONLY, os.ModePerm)
 	assert.NoError(t, err)
-	newBuf := make([]byte, buff.PageSize)
+	newBuf := make([]byte, buff.DefaultPageSize)
 	n, err := file.Read(newBuf)
 	assert.NoError(t, err)
-	assert.Equal(t, buff.PageSize, n)
+	assert.Equal(t, buff.DefaultPageSize, n)
 
 	h2 := castGenericNode(10, newMockPage(newBuf))
 	assert.Equal(t, h.size, h2.size)
@@ -79,20 +78,19 @@ func Test_castBranchPage(t *testing.T) {
 }
 
 func Test_castHeaderPage(t *testing.T) {
-	testFile := "./testdb"
-	somePage := make([]byte, buff.PageSize)
+	testFile := filepath.Join(t.TempDir(), "testdb")
+	somePage := make([]byte, buff.DefaultPageSize)
 	h := castHeaderPage(somePage)
 	h.flags = headerFlagInit
 	h.rootPgid = 1
 	h.nodeSize = 11
 	assert.NoError(t, os.WriteFile(testFile, somePage, os.ModePerm))
-	defer os.Remove(testFile)
 	file, err := os.OpenFile(testFile, os.O_RDONLY, os.ModePerm)
 	assert.NoError(t, err)
-	newBuf := make([]byte, buff.PageSize)
+	newBuf := make([]byte, buff.DefaultPageSize)
 	n, err := file.Read(newBuf)
 	assert.NoError(t, err)
-	assert.Equal(t, buff.PageSize, n)
+	assert.Equal(t, buff.DefaultPageSize, n)
 
 	h2 := castHeaderPage(newBuf)
 	assert.Equal(t, h.flags, h2.flags)
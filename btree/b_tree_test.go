@@ -4,6 +4,7 @@ import (
 	"buff"
 	"bufio"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -13,10 +14,16 @@ func Test_PrintBtree(t *testing.T) {
 	var (
 		leafMaxSize, internalMaxSize int
 	)
-	dm := buff.NewDiskManager("test.db")
+	dm, err := buff.NewDiskManager(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
 	bpm := buff.NewBufferPool(100, dm)
 
-	headerPage := bpm.NewPage()
+	headerPage, err := bpm.NewPage()
+	if err != nil {
+		t.Fatal(err)
+	}
 	leafMaxSize = readInt(r)
 	internalMaxSize = readInt(r)
 	tree := NewTree("foo_pk", bpm, IntComp, leafMaxSize, internalMaxSize)
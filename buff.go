@@ -2,288 +2,585 @@ package buff
 
 import (
 	"container/list"
+	"errors"
 	"fmt"
+	"sort"
 	"sync"
 )
 
+// Pool is the part of BufferPool that ParallelBufferPool implements as well,
+// for callers that work with either
+type Pool interface {
+	PageSize() int
+	PageDataSize() int
+	NewPage() (*Page, error)
+	FetchPage(pageID int) (*Page, error)
+	UnpinPage(pageID int, isDirty bool) bool
+	// DeletePage returns false if the page is pinned or cannot be deallocated
+	DeletePage(pageID int) bool
+	FlushPage(pageID int) error
+	Sync() error
+	Close() error
+}
+
 type BufferPool struct {
-	numInstances int
-	size         int
-	diskManager  *DiskManager
-	pages        []Page
-	pageTable    map[int]*Page
-	replacer     Replacer
-	freeList     *list.List
+	numInstances  int
+	instanceIndex int
+	size          int
+	pageSize      int
+	diskManager   DiskManager
+	// frames indexed by frame id, Resize may renumber them
+	pages     []*Page
+	pageTable map[int]*Page
+	replacer  Replacer
+	// creates the replacer for a given number of frames, nil if the replacer was given by WithReplacer
+	newReplacer func(size int) Replacer
+	freeList    *list.List
 	// Page table map[page-id] frame id
 	// Replacer
-	mu          *sync.Mutex
-	nextNewPage int
+	mu       *sync.Mutex
+	counters counters
+	// caller stacks of outstanding pins by page id, nil unless WithPinTracking is used
+	pinStacks map[int][]string
+	flusher   *backgroundFlusher
+	// number of resident dirty pages, kept up to date by lockedSetDirty
+	dirtyPages int
+	// page reads and writes go through scheduler if it is set
+	scheduler *DiskScheduler
+}
+
+// Option customizes a BufferPool created by NewBufferPool
+type Option func(*BufferPool)
+
+// WithReplacer overrides the default LRU replacement policy,
+// r must be able to track frame ids in range [0, size)
+func WithReplacer(r Replacer) Option {
+	return func(b *BufferPool) {
+		b.replacer = r
+		b.newReplacer = nil
+	}
+}
+
+// WithReplacerFunc is like WithReplacer, but creates the replacer from the
+// pool size, it is required for pools holding more than one instance and for Resize
+func WithReplacerFunc(newReplacer func(size int) Replacer) Option {
+	return func(b *BufferPool) {
+		// the replacer is created once every option is applied
+		b.replacer = nil
+		b.newReplacer = newReplacer
+	}
+}
+
+func newDefaultReplacer(size int) Replacer {
+	return NewLRUReplacer(size)
+}
+
+// WithDiskScheduler makes the pool issue its page reads and writes through s,
+// the caller owns s and shuts it down after closing the pool
+func WithDiskScheduler(s *DiskScheduler) Option {
+	return func(b *BufferPool) {
+		b.scheduler = s
+	}
+}
+
+func NewBufferPool(size int, d DiskManager, opts ...Option) *BufferPool {
+	return newBufferPoolInstance(size, 1, 0, d, opts...)
 }
 
-func NewBufferPool(size int, d *DiskManager) *BufferPool {
-	pages := make([]Page, size)
+// newBufferPoolInstance creates one shard of a ParallelBufferPool, the instance
+// only allocates page ids that satisfy pageID % numInstances == instanceIndex
+func newBufferPoolInstance(size, numInstances, instanceIndex int, d DiskManager, opts ...Option) *BufferPool {
+	pages := make([]*Page, size)
 	freeList := list.New()
 	for idx := range pages {
-		pages[idx].mu = &sync.RWMutex{}
-		pages[idx].frameID = idx
-		pages[idx].pageID = invalidPageID
+		pages[idx] = newFrame(idx)
 		freeList.PushFront(idx)
 	}
-	return &BufferPool{
-		size:         size,
-		diskManager:  d,
-		pages:        pages,
-		replacer:     NewLRUReplacer(size),
-		freeList:     freeList,
-		mu:           &sync.Mutex{},
-		pageTable:    map[int]*Page{},
-		numInstances: 1,
+	b := &BufferPool{
+		size:          size,
+		pageSize:      d.PageSize(),
+		diskManager:   d,
+		pages:         pages,
+		newReplacer:   newDefaultReplacer,
+		freeList:      freeList,
+		mu:            &sync.Mutex{},
+		pageTable:     map[int]*Page{},
+		numInstances:  numInstances,
+		instanceIndex: instanceIndex,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	if b.newReplacer != nil {
+		b.replacer = b.newReplacer(size)
 	}
+	if b.flusher != nil {
+		go b.runFlusher()
+	}
+	return b
+}
+
+// lockedAllocatePage allocates a page id owned by this instance on disk
+func (b *BufferPool) lockedAllocatePage() (int, error) {
+	return b.diskManager.AllocatePage(b.numInstances, b.instanceIndex)
 }
-func (b *BufferPool) lockedAllocatePage() int {
-	newpage := b.nextNewPage
-	b.nextNewPage += b.numInstances
-	return newpage
+
+// PageSize is the page size of the disk manager, trailer included
+func (b *BufferPool) PageSize() int {
+	return b.pageSize
+}
+
+// PageDataSize is the number of bytes of a page available to users of the pool, see Page.GetData
+func (b *BufferPool) PageDataSize() int {
+	return b.pageSize - pageTrailerSize
 }
+
 func (b *Page) GetPageID() int {
 	return b.pageID
 }
+
+// Close stops the background flusher, flushes every resident page and closes the underlying
+// disk manager, it refuses to close and returns ErrPagesPinned if any page is still pinned.
+// The flusher is stopped first, as it pins the pages it writes back, and is not restarted on failure
 func (b *BufferPool) Close() error {
-	return b.diskManager.f.Close()
+	b.stopFlusher()
+	if err := b.checkNoPinnedPages(); err != nil {
+		return err
+	}
+	if err := b.FlushAllPages(); err != nil {
+		return err
+	}
+	if err := b.diskManager.Sync(); err != nil {
+		return err
+	}
+	return b.diskManager.Close()
 }
 
-func (b *BufferPool) NewPage() *Page {
-	var (
-		pageID      int
-		page        *Page
-		unavailable bool
-		victimed    bool
-		freeFrame   int
-	)
+// Sync is a durability barrier, every page modified and unpinned as dirty
+// before the call is on stable storage when it returns
+func (b *BufferPool) Sync() error {
+	if err := b.FlushAllPages(); err != nil {
+		return err
+	}
+	return b.diskManager.Sync()
+}
+
+// Size returns the number of frames of the pool
+func (b *BufferPool) Size() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size
+}
+
+func (b *BufferPool) checkNoPinnedPages() error {
+	leaks := b.PinLeaks()
+	if len(leaks) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrPagesPinned, formatPinLeaks(leaks))
+}
+
+// FlushAllPages writes every dirty page currently in the buffer to disk
+func (b *BufferPool) FlushAllPages() error {
+	var pageIDs []int
 	locked(b.mu, func() {
-		// new frame available
-		if b.freeList.Len() != 0 {
-			free := b.freeList.Front()
-			b.freeList.Remove(free)
-			freeFrame = free.Value.(int)
-		} else {
-			// try finding new frame from replacer
-			frameID, ok := b.replacer.Victim()
-			if !ok {
-				unavailable = true
-				return
+		for pageID, page := range b.pageTable {
+			if page.dirty {
+				pageIDs = append(pageIDs, pageID)
 			}
-			freeFrame = frameID
-			victimed = true
 		}
-		// b.replacer.Pin()
-		page = &b.pages[freeFrame]
-		if page.pageID != invalidPageID {
-			delete(b.pageTable, page.pageID)
+	})
+	sort.Ints(pageIDs)
+	for _, pageID := range pageIDs {
+		if err := b.FlushPage(pageID); err != nil {
+			return fmt.Errorf("failed to flush page %d: %w", pageID, err)
 		}
+	}
+	return nil
+}
 
-		pageID = b.lockedAllocatePage()
-		b.pageTable[pageID] = page
-		// now we need to lock, releasing big lock, but still prevent
-		// other thread that fetching this page from modifying it
-		page.mu.Lock()
+var (
+	// ErrBufferFull is returned when every frame in the pool is pinned
+	ErrBufferFull = errors.New("buffer full")
+	// ErrPagesPinned is returned when closing a pool that still has pinned pages
+	ErrPagesPinned = errors.New("pages are still pinned")
+)
 
-	})
-	if unavailable {
-		return nil
+// lockedFindFreeFrame picks a frame from the free list first, then from the replacer.
+// A dirty victim is not written back under the pool latch, its page id is returned
+// instead of a frame, see lockedEvict
+func (b *BufferPool) lockedFindFreeFrame() (*Page, int, error) {
+	if b.freeList.Len() != 0 {
+		free := b.freeList.Front()
+		b.freeList.Remove(free)
+		return b.pages[free.Value.(int)], invalidPageID, nil
 	}
+	return b.lockedEvict()
+}
 
-	defer page.mu.Unlock()
-	if victimed && page.dirty {
-		err := b.diskManager.WritePage(int64(page.pageID), page.data)
-		if err != nil {
-			panic(fmt.Sprintf("todo: %s", err))
-		}
+// lockedEvict takes a victim from the replacer and removes it from the page table.
+// A dirty victim stays resident and evictable, and its page id is returned, the caller
+// writes it back by writeBackVictim after releasing the pool latch and tries again
+func (b *BufferPool) lockedEvict() (*Page, int, error) {
+	frameID, ok := b.replacer.Victim()
+	if !ok {
+		return nil, invalidPageID, ErrBufferFull
 	}
-
-	page.assignNew(pageID, freeFrame)
-	page.pin()
-	return page
-	// 0.   Make sure you call AllocatePage!
-	// 1.   If all the pages in the buffer pool are pinned, return nullptr.
-	// 2.   Pick a victim page P from either the free list or the replacer. Always pick from the free list first.
-	// 3.   Update P's metadata, zero out memory and add P to the page table.
-	// 4.   Set the page ID output parameter. Return a pointer to P.
+	page := b.pages[frameID]
+	if page.dirty {
+		b.replacer.Unpin(frameID)
+		return nil, page.pageID, nil
+	}
+	incr(&b.counters.evictions)
+	delete(b.pageTable, page.pageID)
+	return page, invalidPageID, nil
 }
 
-func (b *BufferPool) FetchPage(pageID int) (*Page, error) {
-	var (
-		page        *Page
-		unavailable bool
-		inBuffer    bool
-		victimed    bool
-		freeFrame   int
-	)
-	locked(b.mu, func() {
-		page = b.pageTable[pageID]
-		// page already in buffer, pin++ and return
-		if page != nil {
-			locked(page.mu, func() {
-				page.pinCount++
-			})
+// writeBackVictim writes back a dirty victim returned by lockedEvict, the pool latch must not be held.
+// The page is pinned by FlushPage during the write, so it cannot be evicted before it is clean
+func (b *BufferPool) writeBackVictim(pageID int) error {
+	if err := b.FlushPage(pageID); err != nil {
+		return fmt.Errorf("failed to write back victim page %d: %w", pageID, err)
+	}
+	return nil
+}
 
-			b.replacer.Pin(page.frameID)
-			inBuffer = true
-			return
-		}
-		// new frame available
-		if b.freeList.Len() != 0 {
-			free := b.freeList.Front()
-			b.freeList.Remove(free)
-			freeFrame = free.Value.(int)
-		} else {
-			// try finding new frame from replacer
-			frameID, ok := b.replacer.Victim()
-			if !ok {
-				unavailable = true
-				return
-			}
-			freeFrame = frameID
-			victimed = true
-		}
-		// b.replacer.Pin()
-		page = &b.pages[freeFrame]
+func (b *BufferPool) lockedPin(page *Page) {
+	page.pin()
+	b.replacer.Pin(page.frameID)
+}
 
-		// don't need to use lock here, we are the only one using this free page
-		if page.pageID != invalidPageID {
-			delete(b.pageTable, page.pageID)
-		}
-		b.pageTable[pageID] = page
-		// now we need to lock, releasing big lock, but still prevent
-		// other thread that fetching this page from modifying it
-		page.mu.Lock()
+// lockedSetDirty sets the dirty flag of page, counting dirty pages for the background flusher
+func (b *BufferPool) lockedSetDirty(page *Page, dirty bool) {
+	if page.dirty == dirty {
+		return
+	}
+	page.dirty = dirty
+	if dirty {
+		b.dirtyPages++
+	} else {
+		b.dirtyPages--
+	}
+}
 
-	})
-	if unavailable {
-		return nil, fmt.Errorf("buffer full")
+// lockedUnpin returns false if page was not pinned
+func (b *BufferPool) lockedUnpin(page *Page) bool {
+	if page.pinCount <= 0 {
+		return false
 	}
-	if inBuffer {
-		return page, nil
+	page.pinCount--
+	if page.pinCount == 0 {
+		b.replacer.Unpin(page.frameID)
 	}
-	defer page.mu.Unlock()
-	if victimed && page.dirty {
-		err := b.diskManager.WritePage(int64(page.pageID), page.data)
-		if err != nil {
-			panic(fmt.Sprintf("todo: %s", err))
+	return true
+}
+
+func (b *BufferPool) NewPage() (*Page, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// 0.   Make sure you call AllocatePage!
+	// 1.   If all the pages in the buffer pool are pinned, return ErrBufferFull.
+	// 2.   Pick a victim page P from either the free list or the replacer. Always pick from the free list first.
+	// 3.   Update P's metadata, zero out memory and add P to the page table.
+	// 4.   Set the page ID output parameter. Return a pointer to P.
+	page, dirty, err := b.lockedFindFreeFrame()
+	for err == nil && dirty != invalidPageID {
+		b.mu.Unlock()
+		err = b.writeBackVictim(dirty)
+		b.mu.Lock()
+		if err == nil {
+			page, dirty, err = b.lockedFindFreeFrame()
 		}
 	}
-
-	page.assignNew(pageID, freeFrame)
-	err := b.diskManager.ReadPage(int64(pageID), page.data)
 	if err != nil {
 		return nil, err
 	}
+	pageID, err := b.lockedAllocatePage()
+	if err != nil {
+		page.reset()
+		b.freeList.PushFront(page.frameID)
+		return nil, err
+	}
+	// don't need to use page lock here, no one else can reach this frame
+	page.assignNew(pageID, page.frameID, b.pageSize)
 	page.pin()
+	b.lockedRecordPin(pageID)
+	b.replacer.RecordAccess(page.frameID)
+	b.pageTable[pageID] = page
 	return page, nil
+}
+
+func (b *BufferPool) FetchPage(pageID int) (*Page, error) {
+	b.mu.Lock()
 	// 1.     Search the page table for the requested page (P).
 	// 1.1    If P exists, pin it and return it immediately.
 	// 1.2    If P does not exist, find a replacement page (R) from either the free list or the replacer.
 	//        Note that pages are always found from the free list first.
-	// 2.     If R is dirty, write it back to the disk.
+	// 2.     If R is dirty, write it back to the disk without holding the pool latch and start over.
 	// 3.     Delete R from the page table and insert P.
 	// 4.     Update P's metadata, read in the page content from disk, and then return a pointer to P.
+	if page := b.pageTable[pageID]; page != nil {
+		incr(&b.counters.fetchHits)
+		b.lockedPin(page)
+		b.lockedRecordPin(pageID)
+		b.replacer.RecordAccess(page.frameID)
+		// page may still be read in by another FetchPage or Prefetch
+		load := page.loading
+		b.mu.Unlock()
+		if err := b.waitLoaded(page, load); err != nil {
+			return nil, err
+		}
+		return page, nil
+	}
+	page, dirty, err := b.lockedStartLoad(pageID)
+	if err == nil && dirty != invalidPageID {
+		b.mu.Unlock()
+		if err := b.writeBackVictim(dirty); err != nil {
+			return nil, err
+		}
+		// pageID may have been fetched by someone else meanwhile
+		return b.FetchPage(pageID)
+	}
+	incr(&b.counters.fetchMisses)
+	if err != nil {
+		b.mu.Unlock()
+		return nil, err
+	}
+	b.lockedRecordPin(pageID)
+	load := page.loading
+	b.mu.Unlock()
+
+	// read without holding the pool latch, others fetching this page wait for load
+	b.finishLoad(page, b.readPage(pageID, page.data))
+	if err := b.waitLoaded(page, load); err != nil {
+		return nil, err
+	}
+	return page, nil
 }
-func (b *BufferPool) DeletePage(pageID int) bool {
-	// TODO: call deallocate page, future NewPage call can reuse this free page on disk
-	var (
-		page    *Page
-		frameID int
-		deleted bool
-	)
-	locked(b.mu, func() {
-		page = b.pageTable[pageID]
-		if page != nil {
-			// page is loaded in buffer, need to reclaim the frame
-			var (
-				pinCount int
-			)
-			locked(page.mu, func() {
-				pinCount = page.pinCount
-				if pinCount > 1 {
-					return
-				}
-				// can safely delete page
-				deleted = true
-				page.reset()
-				frameID = page.frameID
 
-			})
-			if deleted {
-				delete(b.pageTable, pageID)
-			}
+// Prefetch starts reading pageID into the buffer in the background, it returns
+// without waiting for the read. A later FetchPage of pageID waits for the read to finish
+func (b *BufferPool) Prefetch(pageID int) error {
+	b.mu.Lock()
+	if b.pageTable[pageID] != nil {
+		b.mu.Unlock()
+		return nil
+	}
+	page, dirty, err := b.lockedStartLoad(pageID)
+	if err == nil && dirty != invalidPageID {
+		b.mu.Unlock()
+		if err := b.writeBackVictim(dirty); err != nil {
+			return err
 		}
+		return b.Prefetch(pageID)
+	}
+	if err != nil {
+		b.mu.Unlock()
+		return err
+	}
+	b.lockedRecordPin(pageID)
+	load := page.loading
+	b.mu.Unlock()
+
+	go func() {
+		b.finishLoad(page, b.readPage(pageID, page.data))
+		// failed load has already been released by waitLoaded
+		if b.waitLoaded(page, load) == nil {
+			b.UnpinPage(pageID, false)
+		}
+	}()
+	return nil
+}
+
+// pageLoad tracks an in flight read of a page, done is closed once the read finishes
+type pageLoad struct {
+	done chan struct{}
+	err  error
+}
+
+// lockedStartLoad maps pageID to a free frame, pinned once by the caller,
+// its content is undefined until finishLoad is called. Nothing is mapped if
+// a dirty victim has to be written back first, see lockedFindFreeFrame
+func (b *BufferPool) lockedStartLoad(pageID int) (*Page, int, error) {
+	page, dirty, err := b.lockedFindFreeFrame()
+	if err != nil || dirty != invalidPageID {
+		return nil, dirty, err
+	}
+	page.assignNew(pageID, page.frameID, b.pageSize)
+	page.pin()
+	page.loading = &pageLoad{done: make(chan struct{})}
+	b.replacer.RecordAccess(page.frameID)
+	b.pageTable[pageID] = page
+	return page, invalidPageID, nil
+}
+
+// finishLoad publishes the result of reading page from disk and wakes up waiters,
+// a failed load stays in the page table until every holder has released it
+func (b *BufferPool) finishLoad(page *Page, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	load := page.loading
+	load.err = err
+	if err == nil {
+		page.loading = nil
+	}
+	close(load.done)
+}
+
+// waitLoaded blocks until load is done, on failure the pin of the caller is released
+// and the frame is given back once nobody holds the page anymore
+func (b *BufferPool) waitLoaded(page *Page, load *pageLoad) error {
+	if load == nil {
+		return nil
+	}
+	<-load.done
+	if load.err == nil {
+		return nil
+	}
+	locked(b.mu, func() {
+		b.lockedRecordUnpin(page.pageID)
+		b.lockedDropFailedPin(page)
 	})
-	// page is not loaded in buffer, safe to return now
-	// TODO: even if page is not loaded in buffer, need to make its content empty or mark tombstone on disk
-	if page == nil {
-		return true
+	return load.err
+}
+
+func (b *BufferPool) lockedDropFailedPin(page *Page) {
+	page.pinCount--
+	if page.pinCount > 0 {
+		return
+	}
+	// frame holds nothing useful now, give it back
+	delete(b.pageTable, page.pageID)
+	b.lockedSetDirty(page, false)
+	page.reset()
+	b.freeList.PushFront(page.frameID)
+}
+
+// readPage reads pageID into data and verifies its checksum,
+// a mismatch is reported as *CorruptPageError
+func (b *BufferPool) readPage(pageID int, data []byte) error {
+	incr(&b.counters.diskReads)
+	var err error
+	if b.scheduler != nil {
+		err = <-b.scheduler.ScheduleRead(pageID, data)
+	} else {
+		err = b.diskManager.ReadPage(int64(pageID), data)
+	}
+	if err != nil {
+		return err
 	}
-	if deleted {
-		locked(b.mu, func() {
-			b.freeList.PushFront(frameID)
-		})
+	return verifyChecksum(pageID, data)
+}
+
+func (b *BufferPool) writePage(pageID int, data []byte) error {
+	incr(&b.counters.diskWrites)
+	data = withChecksum(pageID, data)
+	if b.scheduler != nil {
+		return <-b.scheduler.ScheduleWrite(pageID, data)
 	}
+	return b.diskManager.WritePage(int64(pageID), data)
+}
 
-	return true
+// DeletePage releases the frame of pageID and deallocates it on disk, so that
+// future NewPage calls can reuse it. Returns false if the page is still pinned,
+// the caller included, or cannot be deallocated
+func (b *BufferPool) DeletePage(pageID int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	// 0.   Make sure you call DeallocatePage!
 	// 1.   Search the page table for the requested page (P).
 	// 1.   If P does not exist, return true.
 	// 2.   If P exists, but has a non-zero pin-count, return false. Someone is using the page.
 	// 3.   Otherwise, P can be deleted. Remove P from the page table, reset its metadata and return it to the free list.
+	page := b.pageTable[pageID]
+	// a holder of a pin on a deleted page would unpin or write back the page reusing its id
+	if page != nil && (page.pinCount > 0 || page.loading != nil) {
+		return false
+	}
+	if err := b.diskManager.DeallocatePage(pageID); err != nil {
+		return false
+	}
+	// page is not loaded in buffer, nothing more to do
+	if page == nil {
+		return true
+	}
+	// page is loaded in buffer, need to reclaim the frame
+	b.replacer.Pin(page.frameID)
+	delete(b.pinStacks, pageID)
+	b.lockedSetDirty(page, false)
+	page.reset()
+	delete(b.pageTable, pageID)
+	b.freeList.PushFront(page.frameID)
+	return true
 }
 
 func (b *BufferPool) UnpinPage(pageID int, isDirty bool) bool {
-	var (
-		page *Page
-		ret  bool
-	)
-	locked(b.mu, func() {
-		page = b.pageTable[pageID]
-		if page != nil {
-			var (
-				frameID int
-				prevPin int
-			)
-			locked(page.mu, func() {
-				prevPin = page.pinCount
-				page.pinCount--
-				frameID = page.frameID
-				page.dirty = isDirty
-			})
-			if prevPin == 1 {
-				b.replacer.Unpin(frameID)
-			}
-			ret = prevPin > 0
-		}
-	})
-	return ret
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	page := b.pageTable[pageID]
+	if page == nil {
+		return false
+	}
+	// once marked dirty, the page stays dirty until it is written back
+	if isDirty {
+		b.lockedSetDirty(page, true)
+	}
+	if !b.lockedUnpin(page) {
+		return false
+	}
+	if isDirty {
+		b.lockedWakeFlusher()
+	}
+	b.lockedRecordUnpin(pageID)
+	return true
 }
 
-func (b *BufferPool) FlushPage(pageID int) {
+// FlushPage writes page content to disk if it is in the buffer and clears its dirty flag,
+// the page is pinned during the write so that it cannot be evicted
+func (b *BufferPool) FlushPage(pageID int) error {
 	var (
-		page *Page
+		page     *Page
+		wasDirty bool
+		load     *pageLoad
 	)
 	locked(b.mu, func() {
 		page = b.pageTable[pageID]
-		// page already in buffer, pin++ and return
 		if page != nil {
-			page.mu.Lock()
-			return
+			wasDirty = page.dirty
+			load = page.loading
+			b.lockedPin(page)
 		}
 	})
 	if page == nil {
-		return
+		return nil
 	}
-	defer page.mu.Unlock()
-	err := b.diskManager.WritePage(int64(pageID), page.data)
+	if load != nil {
+		<-load.done
+		if load.err != nil {
+			// page has never been read in, nothing to write
+			locked(b.mu, func() {
+				b.lockedDropFailedPin(page)
+			})
+			return nil
+		}
+	}
+	defer locked(b.mu, func() {
+		b.lockedUnpin(page)
+	})
+	page.mu.RLock()
+	defer page.mu.RUnlock()
+	err := b.writePage(pageID, page.data)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if wasDirty {
+		incr(&b.counters.dirtyFlushes)
 	}
+	// still holding the read latch, any later modification will mark it dirty again
+	locked(b.mu, func() {
+		b.lockedSetDirty(page, false)
+	})
+	return nil
 }
 
 const (
@@ -298,6 +595,16 @@ type Page struct {
 	dataSize int
 	dirty    bool
 	mu       *sync.RWMutex
+	// non nil while the page content is being read from disk
+	loading *pageLoad
+}
+
+func newFrame(frameID int) *Page {
+	return &Page{
+		mu:      &sync.RWMutex{},
+		frameID: frameID,
+		pageID:  invalidPageID,
+	}
 }
 
 func (p *Page) GetLock() *sync.RWMutex {
@@ -314,8 +621,8 @@ func (p *Page) flushIfIsDirty() bool {
 
 // TODO: this is meaningless
 func (p *Page) Write(data []byte) error {
-	if len(data) > PageSize {
-		return fmt.Errorf("cannot write more than page size %d", PageSize)
+	if dataSize := len(p.data) - pageTrailerSize; len(data) > dataSize {
+		return fmt.Errorf("cannot write more than page data size %d", dataSize)
 	}
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -323,21 +630,26 @@ func (p *Page) Write(data []byte) error {
 	return nil
 }
 
+// GetData returns the content of the page, the checksum trailer is not part of it
 func (p *Page) GetData() []byte {
-	return p.data
+	return p.data[:len(p.data)-pageTrailerSize]
 }
 
 func (p *Page) reset() {
-	p.data = make([]byte, PageSize) //todo: reuse somehow
+	p.data = make([]byte, len(p.data)) //todo: reuse somehow
 	p.dirty = false
 	p.pageID = invalidPageID
+	p.pinCount = 0
+	p.loading = nil
 }
 
-func (p *Page) assignNew(pageID int, frameID int) {
+func (p *Page) assignNew(pageID, frameID, pageSize int) {
 	p.pageID = pageID
 	p.frameID = frameID
-	p.data = make([]byte, PageSize) //todo: reuse somehow
+	p.data = make([]byte, pageSize) //todo: reuse somehow
 	p.dirty = false
+	p.pinCount = 0
+	p.loading = nil
 }
 
 func (p *Page) pin() {
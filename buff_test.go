@@ -5,6 +5,9 @@ import (
 	"log"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -16,66 +19,95 @@ func init() {
 	}()
 }
 
+func testDBFile(t *testing.T) string {
+	return filepath.Join(t.TempDir(), "test.db")
+}
+
+func newMemDisk(t *testing.T, opts ...DiskOption) *MemDiskManager {
+	disk, err := NewMemDiskManager(opts...)
+	assert.NoError(t, err)
+	return disk
+}
+
+func newFaultDisk(t *testing.T, seed int64, opts ...DiskOption) *FaultDiskManager {
+	disk, err := NewFaultDiskManager(seed, opts...)
+	assert.NoError(t, err)
+	return disk
+}
+
 func Test_BPMBinaryDataTest(t *testing.T) {
-	disk := NewDiskManager("test.db")
+	disk, err := NewDiskManager(testDBFile(t))
+	assert.NoError(t, err)
 	poolSize := 10
 	bpm := NewBufferPool(poolSize, disk)
 
-	page := bpm.NewPage()
+	page, err := bpm.NewPage()
+	assert.NoError(t, err)
 	assert.NotNil(t, page)
 	assert.Equal(t, 0, page.pageID)
-	var randomBinData [PageSize]byte
-	_, err := rand.Read(randomBinData[:])
+	randomBinData := make([]byte, bpm.PageDataSize())
+	_, err = rand.Read(randomBinData)
 	assert.NoError(t, err)
 
-	randomBinData[PageSize/2] = '0'
-	randomBinData[PageSize-1] = '0'
-	copy(page.GetData(), randomBinData[:])
+	randomBinData[len(randomBinData)/2] = '0'
+	randomBinData[len(randomBinData)-1] = '0'
+	copy(page.GetData(), randomBinData)
 
 	// still can create poolSize - 1 more page
 	for i := 1; i < poolSize; i++ {
-		assert.NotNil(t, bpm.NewPage())
+		p, err := bpm.NewPage()
+		assert.NoError(t, err)
+		assert.NotNil(t, p)
 	}
 
 	// can't create more page
 	for i := poolSize; i < poolSize*2; i++ {
-		assert.Nil(t, bpm.NewPage())
+		p, err := bpm.NewPage()
+		assert.ErrorIs(t, err, ErrBufferFull)
+		assert.Nil(t, p)
 	}
 
 	// should be able to create more 5 page after unpinning 5 page
 	for i := 0; i < 5; i++ {
 		assert.True(t, bpm.UnpinPage(i, true))
-		bpm.FlushPage(i)
+		assert.NoError(t, bpm.FlushPage(i))
 	}
 
 	for i := 0; i < 5; i++ {
-		p := bpm.NewPage()
+		p, err := bpm.NewPage()
+		assert.NoError(t, err)
 		assert.NotNil(t, p)
 		bpm.UnpinPage(p.pageID, false)
 	}
 
 	page0, err := bpm.FetchPage(0)
 	assert.NoError(t, err)
-	assert.Equal(t, page0.GetData(), randomBinData[:])
+	assert.Equal(t, page0.GetData(), randomBinData)
 	assert.True(t, bpm.UnpinPage(0, true))
 
 }
 
 func Test_BPMSampleTest(t *testing.T) {
-	disk := NewDiskManager("test.db")
+	disk, err := NewDiskManager(testDBFile(t))
+	assert.NoError(t, err)
 	poolSize := 10
 	bpm := NewBufferPool(poolSize, disk)
 
-	page := bpm.NewPage()
+	page, err := bpm.NewPage()
+	assert.NoError(t, err)
 	assert.NotNil(t, page)
 	page.Write([]byte("Hello"))
 	assert.Equal(t, []byte("Hello"), page.GetData()[:5])
 	for i := 1; i < poolSize; i++ {
-		assert.NotNil(t, bpm.NewPage())
+		p, err := bpm.NewPage()
+		assert.NoError(t, err)
+		assert.NotNil(t, p)
 	}
 
 	for i := poolSize; i < poolSize*2; i++ {
-		assert.Nil(t, bpm.NewPage())
+		p, err := bpm.NewPage()
+		assert.Error(t, err)
+		assert.Nil(t, p)
 	}
 
 	for i := 0; i < 5; i++ {
@@ -83,16 +115,277 @@ func Test_BPMSampleTest(t *testing.T) {
 	}
 
 	for i := 0; i < 4; i++ {
-		assert.NotNil(t, bpm.NewPage())
+		p, err := bpm.NewPage()
+		assert.NoError(t, err)
+		assert.NotNil(t, p)
 	}
 	page0, _ := bpm.FetchPage(0)
 	assert.Equal(t, []byte("Hello"), page0.GetData()[:5])
 	assert.True(t, bpm.UnpinPage(0, true))
 
-	newPage := bpm.NewPage()
+	newPage, err := bpm.NewPage()
+	assert.NoError(t, err)
 	assert.NotNil(t, newPage)
 
-	page0, err := bpm.FetchPage(0)
+	page0, err = bpm.FetchPage(0)
 	assert.Nil(t, page0)
 	assert.Error(t, err)
 }
+
+func Test_BPMFailedEvictionKeepsVictim(t *testing.T) {
+	disk, err := NewDiskManager(testDBFile(t))
+	assert.NoError(t, err)
+	poolSize := 2
+	bpm := NewBufferPool(poolSize, disk)
+
+	for i := 0; i < poolSize; i++ {
+		p, err := bpm.NewPage()
+		assert.NoError(t, err)
+		copy(p.GetData(), []byte{byte(i + 1)})
+	}
+	assert.True(t, bpm.UnpinPage(0, true))
+
+	// make every following disk write fail
+	assert.NoError(t, disk.f.Close())
+	p, err := bpm.NewPage()
+	assert.Error(t, err)
+	assert.Nil(t, p)
+	_, err = bpm.FetchPage(5)
+	assert.Error(t, err)
+
+	// victim is still resident, dirty and evictable
+	assert.Equal(t, 1, bpm.replacer.Size())
+	page0, err := bpm.FetchPage(0)
+	assert.NoError(t, err)
+	assert.True(t, page0.dirty)
+	assert.Equal(t, byte(1), page0.GetData()[0])
+	assert.Len(t, bpm.pageTable, poolSize)
+}
+
+// blockingDisk blocks writes of page blocked until release is closed
+type blockingDisk struct {
+	DiskManager
+	blocked int64
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (d *blockingDisk) WritePage(pageID int64, data []byte) error {
+	if pageID == d.blocked {
+		close(d.writing)
+		<-d.release
+	}
+	return d.DiskManager.WritePage(pageID, data)
+}
+
+func Test_BPMEvictionWritesBackOutsideLatch(t *testing.T) {
+	disk, err := NewDiskManager(testDBFile(t))
+	assert.NoError(t, err)
+	blocking := &blockingDisk{DiskManager: disk, blocked: 0, writing: make(chan struct{}), release: make(chan struct{})}
+	bpm := NewBufferPool(2, blocking)
+	for i := 0; i < 2; i++ {
+		p, err := bpm.NewPage()
+		assert.NoError(t, err)
+		copy(p.GetData(), []byte{byte(i + 1)})
+	}
+	assert.True(t, bpm.UnpinPage(0, true))
+
+	created := make(chan *Page)
+	go func() {
+		p, err := bpm.NewPage()
+		assert.NoError(t, err)
+		created <- p
+	}()
+	<-blocking.writing
+	// pool latch is free while the victim is written back
+	page1, err := bpm.FetchPage(1)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(2), page1.GetData()[0])
+	assert.True(t, bpm.UnpinPage(1, false))
+	assert.True(t, bpm.UnpinPage(1, false))
+	close(blocking.release)
+
+	p := <-created
+	assert.Equal(t, 2, p.GetPageID())
+	assert.True(t, bpm.UnpinPage(p.GetPageID(), false))
+	page0, err := bpm.FetchPage(0)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(1), page0.GetData()[0])
+	assert.True(t, bpm.UnpinPage(0, false))
+	assert.NoError(t, bpm.Close())
+}
+
+func Test_BPMFlushAllAndClose(t *testing.T) {
+	file := testDBFile(t)
+	disk, err := NewDiskManager(file)
+	assert.NoError(t, err)
+	poolSize := 3
+	bpm := NewBufferPool(poolSize, disk)
+
+	for i := 0; i < poolSize; i++ {
+		p, err := bpm.NewPage()
+		assert.NoError(t, err)
+		copy(p.GetData(), []byte{byte(i + 1)})
+	}
+	assert.True(t, bpm.UnpinPage(0, true))
+	assert.True(t, bpm.UnpinPage(1, true))
+
+	err = bpm.Close()
+	assert.ErrorIs(t, err, ErrPagesPinned)
+	assert.Contains(t, err.Error(), "page 2 pinned 1 time(s)")
+
+	assert.True(t, bpm.UnpinPage(2, true))
+	assert.NoError(t, bpm.Close())
+
+	// every page survives reopening
+	disk, err = NewDiskManager(file)
+	assert.NoError(t, err)
+	bpm = NewBufferPool(poolSize, disk)
+	for i := 0; i < poolSize; i++ {
+		p, err := bpm.FetchPage(i)
+		assert.NoError(t, err)
+		assert.Equal(t, byte(i+1), p.GetData()[0])
+		assert.True(t, bpm.UnpinPage(i, false))
+	}
+	assert.NoError(t, bpm.Close())
+}
+
+func Test_BPMDirtyFlagIsSticky(t *testing.T) {
+	disk, err := NewDiskManager(testDBFile(t))
+	assert.NoError(t, err)
+	poolSize := 2
+	bpm := NewBufferPool(poolSize, disk)
+
+	page, err := bpm.NewPage()
+	assert.NoError(t, err)
+	pageID := page.GetPageID()
+
+	var (
+		wg      sync.WaitGroup
+		holders = 20
+	)
+	for i := 0; i < holders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p, err := bpm.FetchPage(pageID)
+			assert.NoError(t, err)
+			isDirty := i%2 == 0
+			if isDirty {
+				p.GetLock().Lock()
+				p.GetData()[i] = byte(i)
+				p.GetLock().Unlock()
+			}
+			assert.True(t, bpm.UnpinPage(pageID, isDirty))
+		}(i)
+	}
+	wg.Wait()
+	// the last holder unpins with dirty=false
+	assert.True(t, bpm.UnpinPage(pageID, false))
+	assert.True(t, page.dirty)
+
+	// evict the page, its modification must have been written back
+	for i := 0; i < poolSize; i++ {
+		p, err := bpm.NewPage()
+		assert.NoError(t, err)
+		assert.True(t, bpm.UnpinPage(p.GetPageID(), false))
+	}
+	page, err = bpm.FetchPage(pageID)
+	assert.NoError(t, err)
+	for i := 0; i < holders; i += 2 {
+		assert.Equal(t, byte(i), page.GetData()[i])
+	}
+	assert.False(t, page.dirty)
+	assert.True(t, bpm.UnpinPage(pageID, false))
+}
+
+func Test_BPMFlushClearsDirtyAndCleanEvictionSkipsWrite(t *testing.T) {
+	disk, err := NewDiskManager(testDBFile(t))
+	assert.NoError(t, err)
+	bpm := NewBufferPool(1, disk)
+
+	page, err := bpm.NewPage()
+	assert.NoError(t, err)
+	assert.True(t, bpm.UnpinPage(page.GetPageID(), true))
+	assert.True(t, page.dirty)
+	assert.NoError(t, bpm.FlushPage(page.GetPageID()))
+	assert.False(t, page.dirty)
+
+	// evicting the clean page must not write
+	writes := bpm.Stats().DiskWrites
+	_, err = bpm.NewPage()
+	assert.NoError(t, err)
+	assert.Equal(t, writes, bpm.Stats().DiskWrites)
+}
+
+func Test_BPMFetchEvictsCleanPageFromReadOnlyFile(t *testing.T) {
+	file := testDBFile(t)
+	disk, err := NewDiskManager(file)
+	assert.NoError(t, err)
+	bpm := NewBufferPool(1, disk)
+
+	for i := 0; i < 2; i++ {
+		page, err := bpm.NewPage()
+		assert.NoError(t, err)
+		assert.True(t, bpm.UnpinPage(page.GetPageID(), true))
+		assert.True(t, page.dirty)
+	}
+	assert.NoError(t, bpm.FlushPage(1))
+	assert.False(t, bpm.pageTable[1].dirty)
+
+	// any write would fail now, evicting the clean page must not write
+	assert.NoError(t, disk.f.Close())
+	disk.f, err = os.Open(file)
+	assert.NoError(t, err)
+	_, err = bpm.FetchPage(0)
+	assert.NoError(t, err)
+}
+
+func Test_BPMReusesDeallocatedPages(t *testing.T) {
+	file := testDBFile(t)
+	disk, err := NewDiskManager(file)
+	assert.NoError(t, err)
+	bpm := NewBufferPool(3, disk)
+
+	for i := 0; i < 5; i++ {
+		p, err := bpm.NewPage()
+		assert.NoError(t, err)
+		assert.Equal(t, i, p.GetPageID())
+		copy(p.GetData(), []byte{byte(i + 1)})
+		assert.True(t, bpm.UnpinPage(i, true))
+	}
+	// page 1 is resident and unpinned, page 0 has been evicted
+	assert.True(t, bpm.DeletePage(1))
+	assert.True(t, bpm.DeletePage(0))
+	assert.False(t, disk.IsAllocated(0))
+	p, err := bpm.NewPage()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, p.GetPageID())
+	assert.True(t, bpm.UnpinPage(0, true))
+
+	// a pinned page cannot be deleted, whoever holds the pin, its id would be reused under it
+	p, err = bpm.FetchPage(4)
+	assert.NoError(t, err)
+	assert.False(t, bpm.DeletePage(4))
+	assert.True(t, disk.IsAllocated(4))
+	assert.True(t, bpm.UnpinPage(4, false))
+	assert.NoError(t, bpm.Close())
+
+	// allocation survives reopening, page 1 is reused then new pages follow the highest one
+	disk, err = NewDiskManager(file)
+	assert.NoError(t, err)
+	bpm = NewBufferPool(3, disk)
+	for _, expect := range []int{1, 5, 6} {
+		p, err := bpm.NewPage()
+		assert.NoError(t, err)
+		assert.Equal(t, expect, p.GetPageID())
+		assert.True(t, bpm.UnpinPage(expect, false))
+	}
+	for i := 2; i < 5; i++ {
+		p, err := bpm.FetchPage(i)
+		assert.NoError(t, err)
+		assert.Equal(t, byte(i+1), p.GetData()[0])
+		assert.True(t, bpm.UnpinPage(i, false))
+	}
+	assert.NoError(t, bpm.Close())
+}
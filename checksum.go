@@ -0,0 +1,63 @@
+package buff
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// Every page ends with a trailer reserved by the buffer pool, it holds the CRC32C
+// of the page id followed by the rest of the page, so that a page written at the
+// wrong place does not pass for the page stored there. The trailer is written on
+// write-back and verified on read
+const pageTrailerSize = 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// CorruptPageError is returned when the content of a page read from disk does not
+// match its checksum, typically after a torn write
+type CorruptPageError struct {
+	PageID   int
+	Stored   uint32
+	Computed uint32
+}
+
+func (e *CorruptPageError) Error() string {
+	return fmt.Sprintf("page %d is corrupted: stored checksum %08x, computed %08x", e.PageID, e.Stored, e.Computed)
+}
+
+func pageChecksum(pageID int, data []byte) uint32 {
+	var id [8]byte
+	binary.LittleEndian.PutUint64(id[:], uint64(pageID))
+	crc := crc32.Update(0, castagnoli, id[:])
+	return crc32.Update(crc, castagnoli, data[:len(data)-pageTrailerSize])
+}
+
+// withChecksum returns a copy of data with the checksum in its trailer, data itself is left
+// untouched because other holders of the page may be reading it concurrently
+func withChecksum(pageID int, data []byte) []byte {
+	dataSize := len(data) - pageTrailerSize
+	stamped := make([]byte, len(data))
+	copy(stamped, data[:dataSize])
+	binary.LittleEndian.PutUint32(stamped[dataSize:], pageChecksum(pageID, stamped))
+	return stamped
+}
+
+// verifyChecksum accepts a page of zeros, which has been allocated but never written back
+func verifyChecksum(pageID int, data []byte) error {
+	stored := binary.LittleEndian.Uint32(data[len(data)-pageTrailerSize:])
+	computed := pageChecksum(pageID, data)
+	if stored == computed || (stored == 0 && isZeroPage(data)) {
+		return nil
+	}
+	return &CorruptPageError{PageID: pageID, Stored: stored, Computed: computed}
+}
+
+func isZeroPage(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,96 @@
+package buff
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_BPMDetectsCorruptPages(t *testing.T) {
+	file := testDBFile(t)
+	disk, err := NewDiskManager(file)
+	assert.NoError(t, err)
+	bpm := NewBufferPool(3, disk)
+	for i := 0; i < 3; i++ {
+		p, err := bpm.NewPage()
+		assert.NoError(t, err)
+		assert.Len(t, p.GetData(), bpm.PageDataSize())
+		copy(p.GetData(), "hello")
+		// page 1 is allocated but never written back
+		assert.True(t, bpm.UnpinPage(i, i != 1))
+	}
+	assert.NoError(t, bpm.Close())
+
+	// flip a byte behind the pool's back
+	disk, err = NewDiskManager(file)
+	assert.NoError(t, err)
+	raw := make([]byte, DefaultPageSize)
+	assert.NoError(t, disk.ReadPage(0, raw))
+	assert.NoError(t, verifyChecksum(0, raw))
+	raw[1] ^= 0xff
+	assert.NoError(t, disk.WritePage(0, raw))
+
+	bpm = NewBufferPool(3, disk)
+	for i := 0; i < 2; i++ {
+		_, err = bpm.FetchPage(0)
+		var corrupt *CorruptPageError
+		assert.True(t, errors.As(err, &corrupt))
+		assert.Equal(t, 0, corrupt.PageID)
+		assert.NotEqual(t, corrupt.Stored, corrupt.Computed)
+	}
+	for _, f := range bpm.Frames() {
+		assert.Equal(t, invalidPageID, f.PageID)
+	}
+
+	// a page that was never written is all zeros and reads back fine
+	p, err := bpm.FetchPage(1)
+	assert.NoError(t, err)
+	assert.True(t, isZeroPage(p.GetData()))
+	assert.True(t, bpm.UnpinPage(1, false))
+	assert.NoError(t, bpm.Close())
+}
+
+func Test_BPMDetectsMisplacedPages(t *testing.T) {
+	disk := newFaultDisk(t, 1)
+	bpm := NewBufferPool(2, disk)
+	for i := 0; i < 2; i++ {
+		p, err := bpm.NewPage()
+		assert.NoError(t, err)
+		copy(p.GetData(), "hello")
+		assert.True(t, bpm.UnpinPage(i, true))
+	}
+	assert.NoError(t, bpm.Close())
+
+	// a valid page 0 written over page 1 does not verify as page 1
+	raw := make([]byte, DefaultPageSize)
+	assert.NoError(t, disk.ReadPage(0, raw))
+	assert.NoError(t, disk.WritePage(1, raw))
+	bpm = NewBufferPool(2, disk)
+	_, err := bpm.FetchPage(1)
+	var corrupt *CorruptPageError
+	assert.True(t, errors.As(err, &corrupt))
+	assert.Equal(t, 1, corrupt.PageID)
+	assert.NoError(t, bpm.Close())
+}
+
+func Test_BPMDetectsTornWrites(t *testing.T) {
+	disk := newFaultDisk(t, 1)
+	bpm := NewBufferPool(1, disk)
+	p, err := bpm.NewPage()
+	assert.NoError(t, err)
+	copy(p.GetData(), "first")
+	assert.True(t, bpm.UnpinPage(0, true))
+	assert.NoError(t, bpm.Close())
+
+	second := make([]byte, DefaultPageSize)
+	copy(second, "second")
+	disk.TearWrite(1)
+	assert.ErrorIs(t, disk.WritePage(0, withChecksum(0, second)), ErrInjectedFault)
+
+	bpm = NewBufferPool(1, disk)
+	_, err = bpm.FetchPage(0)
+	var corrupt *CorruptPageError
+	assert.True(t, errors.As(err, &corrupt))
+	assert.NoError(t, bpm.Close())
+}
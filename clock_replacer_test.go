@@ -0,0 +1,57 @@
+package buff
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ClockReplacer(t *testing.T) {
+	r := NewClockReplacer(7)
+	testReplacer(t, r)
+}
+
+func Test_ClockReplacerSecondChance(t *testing.T) {
+	r := NewClockReplacer(3)
+	r.Unpin(0)
+	r.Unpin(1)
+	r.Unpin(2)
+
+	// first sweep clears every reference flag, 0 is evicted
+	frameID, ok := r.Victim()
+	assert.True(t, ok)
+	assert.Equal(t, 0, frameID)
+
+	// 1 is referenced again, gets a second chance
+	r.Unpin(1)
+	frameID, ok = r.Victim()
+	assert.True(t, ok)
+	assert.Equal(t, 2, frameID)
+
+	frameID, ok = r.Victim()
+	assert.True(t, ok)
+	assert.Equal(t, 1, frameID)
+
+	_, ok = r.Victim()
+	assert.False(t, ok)
+	assert.Equal(t, 0, r.Size())
+}
+
+func Test_BPMWithClockReplacer(t *testing.T) {
+	disk, err := NewDiskManager(testDBFile(t))
+	assert.NoError(t, err)
+	poolSize := 3
+	bpm := NewBufferPool(poolSize, disk, WithReplacer(NewClockReplacer(poolSize)))
+
+	for i := 0; i < poolSize; i++ {
+		_, err := bpm.NewPage()
+		assert.NoError(t, err)
+	}
+	_, err = bpm.NewPage()
+	assert.ErrorIs(t, err, ErrBufferFull)
+
+	assert.True(t, bpm.UnpinPage(1, false))
+	p, err := bpm.NewPage()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, p.frameID)
+}
@@ -0,0 +1,78 @@
+// rekey rewrites every page of a database file encrypted with AES-GCM under a new key.
+// Keys are read from files holding them hex encoded, so that they do not show up in the
+// process list or the shell history:
+//
+//	rekey -file data.db -old-key old.key -new-key new.key [-compress]
+//
+// The file must not be in use. A crash while rekeying leaves the file under the old key,
+// once the file has switched to the new key the space of the old pages is zeroed
+package main
+
+import (
+	"buff"
+	"compress/flate"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+func main() {
+	file := flag.String("file", "", "database file to rekey")
+	oldKeyFile := flag.String("old-key", "", "file holding the current key")
+	newKeyFile := flag.String("new-key", "", "file holding the new key")
+	compress := flag.Bool("compress", false, "pages are compressed before being encrypted")
+	flag.Parse()
+	if *file == "" || *oldKeyFile == "" || *newKeyFile == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := rekey(*file, *oldKeyFile, *newKeyFile, *compress); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func rekey(file, oldKeyFile, newKeyFile string, compress bool) error {
+	oldCodec, err := codecFromKeyFile(oldKeyFile, compress)
+	if err != nil {
+		return err
+	}
+	newCodec, err := codecFromKeyFile(newKeyFile, compress)
+	if err != nil {
+		return err
+	}
+	disk, err := buff.NewMappedDiskManager(file, oldCodec)
+	if err != nil {
+		return err
+	}
+	if err := disk.Recode(newCodec); err != nil {
+		disk.Close()
+		return err
+	}
+	return disk.Close()
+}
+
+func codecFromKeyFile(keyFile string, compress bool) (buff.PageCodec, error) {
+	content, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, fmt.Errorf("key in %s is not hex encoded: %w", keyFile, err)
+	}
+	aesCodec, err := buff.NewAESGCMCodec(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key in %s: %w", keyFile, err)
+	}
+	if !compress {
+		return aesCodec, nil
+	}
+	flateCodec, err := buff.NewFlateCodec(flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	return buff.ChainCodecs(flateCodec, aesCodec), nil
+}
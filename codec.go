@@ -0,0 +1,111 @@
+package buff
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// PageCodec transforms the bytes of a page on their way to and from a MappedDiskManager,
+// the stored form may have any length
+type PageCodec interface {
+	// Encode is given a seq that differs on every call made by a MappedDiskManager
+	// over the life of its file, codecs can derive nonces from it
+	Encode(pageID int64, seq uint64, data []byte) ([]byte, error)
+	Decode(pageID int64, data []byte) ([]byte, error)
+}
+
+// ChainCodecs encodes with every codec in order and decodes in reverse order,
+// e.g. ChainCodecs(flate, aesgcm) compresses pages before encrypting them
+func ChainCodecs(codecs ...PageCodec) PageCodec {
+	return codecChain(codecs)
+}
+
+type codecChain []PageCodec
+
+func (c codecChain) Encode(pageID int64, seq uint64, data []byte) ([]byte, error) {
+	var err error
+	for _, codec := range c {
+		if data, err = codec.Encode(pageID, seq, data); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+func (c codecChain) Decode(pageID int64, data []byte) ([]byte, error) {
+	var err error
+	for i := len(c) - 1; i >= 0; i-- {
+		if data, err = c[i].Decode(pageID, data); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// first byte of data encoded by FlateCodec
+const (
+	flateRaw byte = iota
+	flateCompressed
+)
+
+// FlateCodec compresses pages with DEFLATE, pages that do not shrink are stored as is
+type FlateCodec struct {
+	level   int
+	writers sync.Pool
+}
+
+// NewFlateCodec returns a codec compressing at level, see compress/flate for the levels
+func NewFlateCodec(level int) (*FlateCodec, error) {
+	if _, err := flate.NewWriter(io.Discard, level); err != nil {
+		return nil, err
+	}
+	return &FlateCodec{level: level}, nil
+}
+
+func (c *FlateCodec) Encode(pageID int64, seq uint64, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(flateCompressed)
+	w, _ := c.writers.Get().(*flate.Writer)
+	if w == nil {
+		var err error
+		if w, err = flate.NewWriter(&buf, c.level); err != nil {
+			return nil, err
+		}
+	} else {
+		w.Reset(&buf)
+	}
+	defer c.writers.Put(w)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if buf.Len() > len(data) {
+		return append([]byte{flateRaw}, data...), nil
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *FlateCodec) Decode(pageID int64, data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("page %d: empty encoded page", pageID)
+	}
+	switch data[0] {
+	case flateRaw:
+		return data[1:], nil
+	case flateCompressed:
+		r := flate.NewReader(bytes.NewReader(data[1:]))
+		defer r.Close()
+		// a page never decompresses to more than MaxPageSize
+		decoded, err := io.ReadAll(io.LimitReader(r, MaxPageSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("page %d: failed to decompress: %w", pageID, err)
+		}
+		return decoded, nil
+	}
+	return nil, fmt.Errorf("page %d: unknown encoding %d", pageID, data[0])
+}
@@ -0,0 +1,61 @@
+package buff
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrPageAuthentication is returned when an encrypted page fails authentication,
+// because it has been tampered with, moved or read with the wrong key
+var ErrPageAuthentication = errors.New("page authentication failed")
+
+// AESGCMCodec encrypts and authenticates pages with AES-GCM. The 96 bits nonce of a write
+// is derived from the page id and the write seq: the low 32 bits of the page id followed by
+// the 64 bits seq, and is stored in front of the ciphertext. A MappedDiskManager never reuses
+// a seq for its file and starts a new file from a random seq, so files encrypted under the
+// same key do not share nonces either. The whole page id is authenticated, so that a page
+// copied over another one does not decrypt
+type AESGCMCodec struct {
+	aead cipher.AEAD
+}
+
+// NewAESGCMCodec takes a 16, 24 or 32 bytes key to select AES-128, AES-192 or AES-256
+func NewAESGCMCodec(key []byte) (*AESGCMCodec, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &AESGCMCodec{aead: aead}, nil
+}
+
+func (c *AESGCMCodec) Encode(pageID int64, seq uint64, data []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(data)+c.aead.Overhead())
+	binary.BigEndian.PutUint32(nonce, uint32(pageID))
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return c.aead.Seal(nonce, nonce, data, pageAAD(pageID)), nil
+}
+
+func (c *AESGCMCodec) Decode(pageID int64, data []byte) ([]byte, error) {
+	nonceSize := c.aead.NonceSize()
+	if len(data) < nonceSize+c.aead.Overhead() {
+		return nil, fmt.Errorf("page %d: %w", pageID, ErrPageAuthentication)
+	}
+	plain, err := c.aead.Open(nil, data[:nonceSize], data[nonceSize:], pageAAD(pageID))
+	if err != nil {
+		return nil, fmt.Errorf("page %d: %w", pageID, ErrPageAuthentication)
+	}
+	return plain, nil
+}
+
+func pageAAD(pageID int64) []byte {
+	aad := make([]byte, 8)
+	binary.BigEndian.PutUint64(aad, uint64(pageID))
+	return aad
+}
@@ -0,0 +1,181 @@
+package buff
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func newEncryptedDisk(t *testing.T, file string, key []byte) *MappedDiskManager {
+	flateCodec, err := NewFlateCodec(flate.BestSpeed)
+	assert.NoError(t, err)
+	aesCodec, err := NewAESGCMCodec(key)
+	assert.NoError(t, err)
+	disk, err := NewMappedDiskManager(file, ChainCodecs(flateCodec, aesCodec))
+	assert.NoError(t, err)
+	return disk
+}
+
+func Test_AESGCMCodec(t *testing.T) {
+	codec, err := NewAESGCMCodec(testKey(1))
+	assert.NoError(t, err)
+	page := make([]byte, DefaultPageSize)
+	copy(page, "secret")
+
+	first, err := codec.Encode(3, 0, page)
+	assert.NoError(t, err)
+	second, err := codec.Encode(3, 1, page)
+	assert.NoError(t, err)
+	assert.NotEqual(t, first, second)
+	assert.False(t, bytes.Contains(first, []byte("secret")))
+	decoded, err := codec.Decode(3, first)
+	assert.NoError(t, err)
+	assert.Equal(t, page, decoded)
+
+	tampered := append([]byte(nil), first...)
+	tampered[len(tampered)/2] ^= 1
+	_, err = codec.Decode(3, tampered)
+	assert.ErrorIs(t, err, ErrPageAuthentication)
+	// a page copied over another one
+	_, err = codec.Decode(4, first)
+	assert.ErrorIs(t, err, ErrPageAuthentication)
+	// page ids are not limited to 32 bits
+	big, err := codec.Encode(1<<40+3, 2, page)
+	assert.NoError(t, err)
+	_, err = codec.Decode(3, big)
+	assert.ErrorIs(t, err, ErrPageAuthentication)
+	decoded, err = codec.Decode(1<<40+3, big)
+	assert.NoError(t, err)
+	assert.Equal(t, page, decoded)
+	// the nonce is made of the low bits of the page id and seq
+	assert.Equal(t, []byte{0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0, 1}, second[:12])
+	assert.Equal(t, []byte{0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0, 2}, big[:12])
+
+	other, err := NewAESGCMCodec(testKey(2))
+	assert.NoError(t, err)
+	_, err = other.Decode(3, first)
+	assert.ErrorIs(t, err, ErrPageAuthentication)
+
+	_, err = NewAESGCMCodec([]byte("short"))
+	assert.Error(t, err)
+}
+
+func Test_EncryptedBPM(t *testing.T) {
+	file := testDBFile(t)
+	bpm := NewBufferPool(2, newEncryptedDisk(t, file, testKey(1)))
+	for i := 0; i < 4; i++ {
+		p, err := bpm.NewPage()
+		assert.NoError(t, err)
+		copy(p.GetData(), "customer data")
+		assert.True(t, bpm.UnpinPage(i, true))
+	}
+	assert.NoError(t, bpm.Close())
+	raw, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.False(t, bytes.Contains(raw, []byte("customer data")))
+
+	bpm = NewBufferPool(2, newEncryptedDisk(t, file, testKey(2)))
+	_, err = bpm.FetchPage(0)
+	assert.ErrorIs(t, err, ErrPageAuthentication)
+	assert.NoError(t, bpm.Close())
+
+	bpm = NewBufferPool(2, newEncryptedDisk(t, file, testKey(1)))
+	p, err := bpm.FetchPage(0)
+	assert.NoError(t, err)
+	assert.Equal(t, "customer data", string(p.GetData()[:13]))
+	assert.True(t, bpm.UnpinPage(0, false))
+	assert.NoError(t, bpm.Close())
+}
+
+func Test_MappedDiskManagerNeverReusesSeq(t *testing.T) {
+	file := testDBFile(t)
+	disk := newEncryptedDisk(t, file, testKey(1))
+	start := disk.seq
+	page := make([]byte, DefaultPageSize)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, disk.WritePage(0, page))
+	}
+	assert.NoError(t, disk.Sync())
+	assert.NoError(t, disk.WritePage(0, page))
+	used := disk.seq
+	// crash, the last write never made it to a checkpoint
+	assert.NoError(t, disk.Close())
+
+	disk = newEncryptedDisk(t, file, testKey(1))
+	assert.GreaterOrEqual(t, disk.seq, used)
+	assert.Equal(t, disk.seq, disk.seqLimit)
+	assert.NoError(t, disk.WritePage(0, page))
+	assert.Equal(t, start+2*seqReservation, disk.seqLimit)
+	assert.NoError(t, disk.Close())
+
+	// files encrypted under the same key start from different numbers
+	other := newEncryptedDisk(t, testDBFile(t), testKey(1))
+	assert.NotEqual(t, start, other.seq)
+	assert.NoError(t, other.Close())
+}
+
+// failingCodec fails to encode page failOn
+type failingCodec struct {
+	PageCodec
+	failOn int64
+}
+
+func (c failingCodec) Encode(pageID int64, seq uint64, data []byte) ([]byte, error) {
+	if pageID == c.failOn {
+		return nil, errors.New("encode failed")
+	}
+	return c.PageCodec.Encode(pageID, seq, data)
+}
+
+func Test_MappedDiskManagerRecode(t *testing.T) {
+	file := testDBFile(t)
+	disk := newEncryptedDisk(t, file, testKey(1))
+	for i := 0; i < 4; i++ {
+		pageID, err := disk.AllocatePage(1, 0)
+		assert.NoError(t, err)
+		assert.NoError(t, disk.WritePage(int64(pageID), filledPage(byte(i))))
+	}
+	assert.NoError(t, disk.Sync())
+
+	newCodec, err := NewAESGCMCodec(testKey(2))
+	assert.NoError(t, err)
+	// a failed recode leaves every page with the old codec
+	assert.Error(t, disk.Recode(failingCodec{newCodec, 2}))
+	buf := make([]byte, DefaultPageSize)
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, disk.ReadPage(int64(i), buf))
+		assert.Equal(t, filledPage(byte(i)), buf)
+	}
+
+	assert.NoError(t, disk.Recode(newCodec))
+	free := append([]span(nil), disk.free...)
+	assert.NotEmpty(t, free)
+	assert.NoError(t, disk.Close())
+
+	// the extents of the old pages have been zeroed
+	raw, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	for _, s := range free {
+		assert.True(t, isZeroPage(raw[s.start*sectorSize:(s.start+s.sectors)*sectorSize]))
+	}
+
+	disk = newEncryptedDisk(t, file, testKey(1))
+	assert.ErrorIs(t, disk.ReadPage(0, buf), ErrPageAuthentication)
+	assert.NoError(t, disk.Close())
+	disk, err = NewMappedDiskManager(file, newCodec)
+	assert.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		assert.True(t, disk.IsAllocated(i))
+		assert.NoError(t, disk.ReadPage(int64(i), buf))
+		assert.Equal(t, filledPage(byte(i)), buf)
+	}
+	assert.NoError(t, disk.Close())
+}
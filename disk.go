@@ -1,71 +1,256 @@
 package buff
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"os"
 	"sync"
 )
 
-type DiskManager struct {
-	m *sync.Mutex
-	f *os.File
+// DiskManager is the storage backend of a buffer pool, pages are addressed by
+// page id and all have the size returned by PageSize
+type DiskManager interface {
+	PageSize() int
+	// ReadPage returns io.EOF if the page has never been written
+	ReadPage(pageID int64, data []byte) error
+	WritePage(pageID int64, data []byte) error
+	// AllocatePage marks the lowest free page id satisfying pageID % numShards == shard
+	// as allocated, pages released by DeallocatePage are reused before new ids are handed out
+	AllocatePage(numShards, shard int) (int, error)
+	DeallocatePage(pageID int) error
+	IsAllocated(pageID int) bool
+	// Sync is a barrier, every write that has completed before the call is
+	// on stable storage when it returns without error
+	Sync() error
+	Close() error
 }
 
 const (
-	PageSize = 4096
+	DefaultPageSize = 4096
+	MinPageSize     = 4 << 10
+	MaxPageSize     = 64 << 10
 )
 
-func NewDiskManager(filename string) *DiskManager {
+// ErrPageSizeMismatch is returned when opening a file with a page size other than the one it was created with
+var ErrPageSizeMismatch = errors.New("page size mismatch")
+
+// checkPageSize accepts powers of two in [MinPageSize, MaxPageSize]
+func checkPageSize(size int) error {
+	if size < MinPageSize || size > MaxPageSize || size&(size-1) != 0 {
+		return fmt.Errorf("page size %d is not a power of two in [%d, %d]", size, MinPageSize, MaxPageSize)
+	}
+	return nil
+}
+
+// diskConfig collects the DiskOptions given to a backend, a backend ignores the options that do not apply to it
+type diskConfig struct {
+	// 0 picks the page size of an existing file, DefaultPageSize for a new one
+	pageSize  int
+	syncMode  SyncMode
+	mmapReads bool
+}
+
+// DiskOption customizes a DiskManager created by one of the backend constructors
+type DiskOption func(*diskConfig)
+
+// WithPageSize chooses the page size of a new database, opening an existing one
+// with another page size fails with ErrPageSizeMismatch
+func WithPageSize(size int) DiskOption {
+	return func(c *diskConfig) {
+		c.pageSize = size
+	}
+}
+
+func newDiskConfig(opts []DiskOption) diskConfig {
+	var c diskConfig
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// pageSizeOrDefault returns the page size of a backend that does not record it
+func (c diskConfig) pageSizeOrDefault() (int, error) {
+	if c.pageSize == 0 {
+		return DefaultPageSize, nil
+	}
+	if err := checkPageSize(c.pageSize); err != nil {
+		return 0, err
+	}
+	return c.pageSize, nil
+}
+
+// FileDiskManager stores pages in a single file. The file starts with a header page recording
+// the layout version and the page size, the rest is divided into groups, each group starts
+// with an allocation bitmap page followed by the data pages it tracks:
+//
+//	| header | map 0 | page 0 | ... | page bits-1 | map 1 | page bits | ...
+//
+// where bits is the number of bits in a page. Pages are accessed with positional reads and
+// writes, so page I/O does not need the mutex, it only guards the allocation bitmaps
+type FileDiskManager struct {
+	m        *sync.Mutex
+	f        *os.File
+	pageSize int
+	alloc    *allocMap
+	syncMode SyncMode
+	commit   *groupCommit
+	// set by WithMmapReads
+	mmap *mmapReader
+}
+
+const (
+	fileMagic = "BUFFFILE"
+	// version of the file layout, bumped on any incompatible change
+	fileVersion = 1
+	// magic, version, page size, crc
+	fileHeaderSize = 8 + 4 + 4 + 4
+)
+
+func NewDiskManager(filename string, opts ...DiskOption) (*FileDiskManager, error) {
+	cfg := newDiskConfig(opts)
 	file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0666)
 	if err != nil {
-		panic(fmt.Sprintf("failed to open file %s", filename))
+		return nil, fmt.Errorf("failed to open file %s: %w", filename, err)
+	}
+	d := &FileDiskManager{
+		m:        &sync.Mutex{},
+		f:        file,
+		syncMode: cfg.syncMode,
+		commit:   newGroupCommit(),
 	}
-	return &DiskManager{
-		m: &sync.Mutex{},
-		f: file,
+	if err := d.loadHeader(cfg.pageSize); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open %s: %w", filename, err)
 	}
+	d.alloc = newAllocMap(d.pageSize, d.writeAllocMap)
+	if err := d.loadAllocMaps(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to load allocation map of %s: %w", filename, err)
+	}
+	if cfg.mmapReads {
+		d.mmap = newMmapReader(file)
+	}
+	return d, nil
 }
 
-func (d *DiskManager) WritePage(pageID int64, data []byte) error {
-	if len(data) != PageSize {
-		return fmt.Errorf("buffer provided must have size %d", PageSize)
-	}
-	d.m.Lock()
-	defer d.m.Unlock()
-	offset := pageID * PageSize
-	_, err := d.f.Seek(offset, 0)
+// loadHeader reads the page size of an existing file or writes the header of a new one,
+// pageSize is the size asked for by the caller, 0 if any
+func (d *FileDiskManager) loadHeader(pageSize int) error {
+	info, err := d.f.Stat()
 	if err != nil {
 		return err
 	}
-	written, err := d.f.Write(data)
-	if err != nil {
+	if info.Size() == 0 {
+		if pageSize == 0 {
+			pageSize = DefaultPageSize
+		}
+		if err := checkPageSize(pageSize); err != nil {
+			return err
+		}
+		d.pageSize = pageSize
+		header := make([]byte, pageSize)
+		copy(header, fileMagic)
+		binary.LittleEndian.PutUint32(header[8:], fileVersion)
+		binary.LittleEndian.PutUint32(header[12:], uint32(pageSize))
+		binary.LittleEndian.PutUint32(header[16:], crc32.Checksum(header[:16], castagnoli))
+		// the header is made durable whatever the sync mode, a file is never left without it
+		if _, err := d.f.WriteAt(header, 0); err != nil {
+			return fmt.Errorf("failed to write file header: %w", err)
+		}
+		return d.f.Sync()
+	}
+
+	header := make([]byte, fileHeaderSize)
+	if _, err := d.f.ReadAt(header, 0); err != nil {
+		return fmt.Errorf("failed to read file header: %w", err)
+	}
+	if string(header[:8]) != fileMagic ||
+		binary.LittleEndian.Uint32(header[16:]) != crc32.Checksum(header[:16], castagnoli) {
+		return fmt.Errorf("invalid file header")
+	}
+	if version := binary.LittleEndian.Uint32(header[8:]); version != fileVersion {
+		return fmt.Errorf("unsupported file version %d, expect %d", version, fileVersion)
+	}
+	d.pageSize = int(binary.LittleEndian.Uint32(header[12:]))
+	if err := checkPageSize(d.pageSize); err != nil {
 		return err
 	}
-	if written != PageSize {
-		return fmt.Errorf("expect writtent byte %d, has %d", PageSize, written)
+	if pageSize != 0 && pageSize != d.pageSize {
+		return fmt.Errorf("file has page size %d, expect %d: %w", d.pageSize, pageSize, ErrPageSizeMismatch)
 	}
-	err = d.f.Sync()
-	return err
+	return nil
+}
+
+func (d *FileDiskManager) PageSize() int {
+	return d.pageSize
 }
 
-func (d *DiskManager) ReadPage(pageID int64, data []byte) error {
-	if len(data) != PageSize {
-		return fmt.Errorf("buffer provided must have size %d", PageSize)
+// groupSize is the size of a bitmap page and of the data pages it tracks
+func (d *FileDiskManager) groupSize() int64 {
+	return int64(d.alloc.bitsPerMap()+1) * int64(d.pageSize)
+}
+
+// physicalOffset maps a page id to its position in the file, skipping the header and bitmap pages
+func (d *FileDiskManager) physicalOffset(pageID int64) int64 {
+	bits := int64(d.alloc.bitsPerMap())
+	group := pageID / bits
+	return d.mapPageOffset(int(group)) + (1+pageID%bits)*int64(d.pageSize)
+}
+
+func (d *FileDiskManager) mapPageOffset(group int) int64 {
+	return int64(d.pageSize) + int64(group)*d.groupSize()
+}
+
+func (d *FileDiskManager) WritePage(pageID int64, data []byte) error {
+	if len(data) != d.pageSize {
+		return fmt.Errorf("buffer provided must have size %d", d.pageSize)
 	}
-	d.m.Lock()
-	defer d.m.Unlock()
-	offset := pageID * PageSize
-	_, err := d.f.Seek(offset, 0)
+	return d.writeAt(d.physicalOffset(pageID), data)
+}
+
+func (d *FileDiskManager) ReadPage(pageID int64, data []byte) error {
+	if len(data) != d.pageSize {
+		return fmt.Errorf("buffer provided must have size %d", d.pageSize)
+	}
+	if d.mmap != nil {
+		return d.mmap.readAt(d.physicalOffset(pageID), data)
+	}
+	return d.readAt(d.physicalOffset(pageID), data)
+}
+
+func (d *FileDiskManager) writeAt(offset int64, data []byte) error {
+	written, err := d.f.WriteAt(data, offset)
 	if err != nil {
 		return err
 	}
+	if written != len(data) {
+		return fmt.Errorf("expect writtent byte %d, has %d", len(data), written)
+	}
+	return d.afterWrite()
+}
 
-	readBytes, err := d.f.Read(data[:PageSize])
-	if err != nil {
+// readAt returns io.EOF if offset is at or beyond the end of file
+func (d *FileDiskManager) readAt(offset int64, data []byte) error {
+	readBytes, err := d.f.ReadAt(data, offset)
+	if readBytes == len(data) {
+		return nil
+	}
+	if readBytes == 0 && err != nil {
 		return err
 	}
-	if readBytes != PageSize {
-		return fmt.Errorf("only read %d from file, expect %d", readBytes, PageSize)
+	return fmt.Errorf("only read %d from file, expect %d: %w", readBytes, len(data), err)
+}
+
+func (d *FileDiskManager) Close() error {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if d.mmap != nil {
+		if err := d.mmap.close(); err != nil {
+			return err
+		}
 	}
-	return nil
+	return d.f.Close()
 }
@@ -0,0 +1,84 @@
+package buff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_DiskManagerPageSize(t *testing.T) {
+	for _, pageSize := range []int{16 << 10, 32 << 10} {
+		file := testDBFile(t)
+		disk, err := NewDiskManager(file, WithPageSize(pageSize))
+		assert.NoError(t, err)
+		assert.Equal(t, pageSize, disk.PageSize())
+		bpm := NewBufferPool(2, disk)
+		for i := 0; i < 3; i++ {
+			p, err := bpm.NewPage()
+			assert.NoError(t, err)
+			assert.Len(t, p.GetData(), pageSize-pageTrailerSize)
+			copy(p.GetData(), bytes.Repeat([]byte{byte(i + 1)}, bpm.PageDataSize()))
+			assert.True(t, bpm.UnpinPage(i, true))
+		}
+		assert.NoError(t, bpm.Close())
+
+		// the page size is read back from the header
+		disk, err = NewDiskManager(file)
+		assert.NoError(t, err)
+		assert.Equal(t, pageSize, disk.PageSize())
+		assert.True(t, disk.IsAllocated(2))
+		assert.Error(t, disk.ReadPage(0, make([]byte, DefaultPageSize)))
+		bpm = NewBufferPool(2, disk)
+		for i := 0; i < 3; i++ {
+			p, err := bpm.FetchPage(i)
+			assert.NoError(t, err)
+			assert.Equal(t, bytes.Repeat([]byte{byte(i + 1)}, bpm.PageDataSize()), p.GetData())
+			assert.True(t, bpm.UnpinPage(i, false))
+		}
+		assert.NoError(t, bpm.Close())
+
+		_, err = NewDiskManager(file, WithPageSize(DefaultPageSize))
+		assert.ErrorIs(t, err, ErrPageSizeMismatch)
+	}
+}
+
+func Test_DiskManagerRejectsInvalidPageSizes(t *testing.T) {
+	for _, pageSize := range []int{MinPageSize / 2, 12 << 10, MaxPageSize * 2} {
+		_, err := NewDiskManager(testDBFile(t), WithPageSize(pageSize))
+		assert.Error(t, err)
+		_, err = NewMemDiskManager(WithPageSize(pageSize))
+		assert.Error(t, err)
+		_, err = NewFaultDiskManager(1, WithPageSize(pageSize))
+		assert.Error(t, err)
+	}
+
+	file := testDBFile(t)
+	assert.NoError(t, os.WriteFile(file, bytes.Repeat([]byte{1}, DefaultPageSize), 0666))
+	_, err := NewDiskManager(file)
+	assert.Error(t, err)
+}
+
+func Test_DiskManagerRejectsOtherVersions(t *testing.T) {
+	file := testDBFile(t)
+	disk, err := NewDiskManager(file)
+	assert.NoError(t, err)
+	assert.NoError(t, disk.Close())
+	header := make([]byte, fileHeaderSize)
+	f, err := os.OpenFile(file, os.O_RDWR, 0666)
+	assert.NoError(t, err)
+	_, err = f.ReadAt(header, 0)
+	assert.NoError(t, err)
+	binary.LittleEndian.PutUint32(header[8:], fileVersion+1)
+	binary.LittleEndian.PutUint32(header[16:], crc32.Checksum(header[:16], castagnoli))
+	_, err = f.WriteAt(header, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	_, err = NewDiskManager(file)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unsupported file version")
+	}
+}
@@ -0,0 +1,291 @@
+package buff
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+var (
+	// ErrInjectedFault is wrapped by every error a FaultDiskManager injects
+	ErrInjectedFault = errors.New("injected fault")
+	// ErrCrashed is returned by a FaultDiskManager after Crash, the pool using it is gone
+	ErrCrashed = errors.New("disk has crashed")
+)
+
+// CrashMode decides what happens to the writes that have not been synced when a FaultDiskManager crashes
+type CrashMode int
+
+const (
+	// CrashDropAll loses every write since the last Sync
+	CrashDropAll CrashMode = iota
+	// CrashRandom keeps, drops or tears each un-synced page independently,
+	// like a disk that persists its write cache in any order
+	CrashRandom
+)
+
+// tearing happens at sector granularity
+const sectorSize = 512
+
+type writeFault int
+
+const (
+	failWrite writeFault = iota + 1
+	tearWrite
+)
+
+// FaultDiskManager is an in-memory backend that injects faults: it fails chosen
+// reads and writes, tears page writes and loses un-synced writes on Crash.
+// Every random decision comes from a source seeded by NewFaultDiskManager, so a
+// run that issues the same operations in the same order replays the same faults
+type FaultDiskManager struct {
+	mu       *sync.Mutex
+	rnd      *rand.Rand
+	pageSize int
+	crashed  bool
+	// durable survives a crash, pending holds pages written since the last Sync
+	durable map[int64][]byte
+	pending map[int64][]byte
+	// alloc is the live allocation state, durableAlloc its copy as of the last Sync
+	alloc        *allocMap
+	durableAlloc [][]byte
+
+	reads       int
+	writes      int
+	readFaults  map[int]struct{}
+	writeFaults map[int]writeFault
+	faultRate   float64
+}
+
+// NewFaultDiskManager only uses WithPageSize
+func NewFaultDiskManager(seed int64, opts ...DiskOption) (*FaultDiskManager, error) {
+	pageSize, err := newDiskConfig(opts).pageSizeOrDefault()
+	if err != nil {
+		return nil, err
+	}
+	return newFaultDiskManager(rand.New(rand.NewSource(seed)), pageSize, map[int64][]byte{}, nil), nil
+}
+
+func newFaultDiskManager(rnd *rand.Rand, pageSize int, durable map[int64][]byte, durableAlloc [][]byte) *FaultDiskManager {
+	d := &FaultDiskManager{
+		mu:           &sync.Mutex{},
+		rnd:          rnd,
+		pageSize:     pageSize,
+		durable:      durable,
+		pending:      map[int64][]byte{},
+		alloc:        newAllocMap(pageSize, nil),
+		durableAlloc: durableAlloc,
+		readFaults:   map[int]struct{}{},
+		writeFaults:  map[int]writeFault{},
+	}
+	d.alloc.maps = copyBitmaps(durableAlloc)
+	return d
+}
+
+func copyBitmaps(maps [][]byte) [][]byte {
+	ret := make([][]byte, len(maps))
+	for i, bitmap := range maps {
+		ret[i] = append([]byte(nil), bitmap...)
+	}
+	return ret
+}
+
+func (d *FaultDiskManager) PageSize() int {
+	return d.pageSize
+}
+
+// FailRead makes the nth read from now fail, n starts at 1
+func (d *FaultDiskManager) FailRead(n int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.readFaults[d.reads+n] = struct{}{}
+}
+
+// FailWrite makes the nth write from now fail without touching the page
+func (d *FaultDiskManager) FailWrite(n int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.writeFaults[d.writes+n] = failWrite
+}
+
+// TearWrite makes the nth write from now store only some leading sectors of the page and fail
+func (d *FaultDiskManager) TearWrite(n int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.writeFaults[d.writes+n] = tearWrite
+}
+
+// SetFaultRate makes every read and write fail with probability rate,
+// half of the failing writes are torn
+func (d *FaultDiskManager) SetFaultRate(rate float64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.faultRate = rate
+}
+
+// Reads returns the number of page reads issued so far, failed ones included
+func (d *FaultDiskManager) Reads() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.reads
+}
+
+// Writes returns the number of page writes issued so far, failed ones included
+func (d *FaultDiskManager) Writes() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.writes
+}
+
+func (d *FaultDiskManager) ReadPage(pageID int64, data []byte) error {
+	if len(data) != d.pageSize {
+		return fmt.Errorf("buffer provided must have size %d", d.pageSize)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.crashed {
+		return ErrCrashed
+	}
+	d.reads++
+	_, fail := d.readFaults[d.reads]
+	delete(d.readFaults, d.reads)
+	if fail || d.lockedRandomFault() {
+		return fmt.Errorf("read %d of page %d: %w", d.reads, pageID, ErrInjectedFault)
+	}
+	page := d.lockedVisiblePage(pageID)
+	if page == nil {
+		return io.EOF
+	}
+	copy(data, page)
+	return nil
+}
+
+func (d *FaultDiskManager) WritePage(pageID int64, data []byte) error {
+	if len(data) != d.pageSize {
+		return fmt.Errorf("buffer provided must have size %d", d.pageSize)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.crashed {
+		return ErrCrashed
+	}
+	d.writes++
+	fault := d.writeFaults[d.writes]
+	delete(d.writeFaults, d.writes)
+	if fault == 0 && d.lockedRandomFault() {
+		fault = failWrite
+		if d.rnd.Intn(2) == 0 {
+			fault = tearWrite
+		}
+	}
+	switch fault {
+	case failWrite:
+		return fmt.Errorf("write %d of page %d: %w", d.writes, pageID, ErrInjectedFault)
+	case tearWrite:
+		torn := d.lockedTear(d.lockedVisiblePage(pageID), data)
+		d.pending[pageID] = torn
+		return fmt.Errorf("write %d of page %d is torn: %w", d.writes, pageID, ErrInjectedFault)
+	}
+	d.pending[pageID] = append([]byte(nil), data...)
+	return nil
+}
+
+func (d *FaultDiskManager) lockedRandomFault() bool {
+	return d.faultRate > 0 && d.rnd.Float64() < d.faultRate
+}
+
+// lockedVisiblePage returns the latest content of a page, nil if it was never written
+func (d *FaultDiskManager) lockedVisiblePage(pageID int64) []byte {
+	if page, ok := d.pending[pageID]; ok {
+		return page
+	}
+	return d.durable[pageID]
+}
+
+// lockedTear returns a page with a random number of leading sectors from newData,
+// the other sectors keep the old content
+func (d *FaultDiskManager) lockedTear(old, newData []byte) []byte {
+	torn := make([]byte, d.pageSize)
+	copy(torn, old)
+	written := (1 + d.rnd.Intn(d.pageSize/sectorSize-1)) * sectorSize
+	copy(torn[:written], newData)
+	return torn
+}
+
+func (d *FaultDiskManager) AllocatePage(numShards, shard int) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.crashed {
+		return 0, ErrCrashed
+	}
+	return d.alloc.allocate(numShards, shard)
+}
+
+func (d *FaultDiskManager) DeallocatePage(pageID int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.crashed {
+		return ErrCrashed
+	}
+	return d.alloc.deallocate(pageID)
+}
+
+func (d *FaultDiskManager) IsAllocated(pageID int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return !d.crashed && d.alloc.isAllocated(pageID)
+}
+
+// Sync makes every pending write and the allocation state durable
+func (d *FaultDiskManager) Sync() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.crashed {
+		return ErrCrashed
+	}
+	for pageID, page := range d.pending {
+		d.durable[pageID] = page
+	}
+	d.pending = map[int64][]byte{}
+	d.durableAlloc = copyBitmaps(d.alloc.maps)
+	return nil
+}
+
+// Close keeps the content, a closed FaultDiskManager can back a new buffer pool
+func (d *FaultDiskManager) Close() error {
+	return nil
+}
+
+// Crash simulates a power loss. It returns the disk as seen after a restart,
+// with the durable pages, the allocation state of the last Sync and no fault scheduled.
+// d itself fails every later call with ErrCrashed, so the pool that was using it
+// cannot write anymore
+func (d *FaultDiskManager) Crash(mode CrashMode) *FaultDiskManager {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.crashed = true
+	durable := make(map[int64][]byte, len(d.durable))
+	for pageID, page := range d.durable {
+		durable[pageID] = page
+	}
+	if mode == CrashRandom {
+		// visit pages in order so that the same seed makes the same decisions
+		pageIDs := make([]int64, 0, len(d.pending))
+		for pageID := range d.pending {
+			pageIDs = append(pageIDs, pageID)
+		}
+		sort.Slice(pageIDs, func(i, j int) bool { return pageIDs[i] < pageIDs[j] })
+		for _, pageID := range pageIDs {
+			switch d.rnd.Intn(3) {
+			case 0:
+				durable[pageID] = d.pending[pageID]
+			case 1:
+				durable[pageID] = d.lockedTear(durable[pageID], d.pending[pageID])
+			}
+		}
+	}
+	return newFaultDiskManager(d.rnd, d.pageSize, durable, d.durableAlloc)
+}
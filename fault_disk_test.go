@@ -0,0 +1,133 @@
+package buff
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func filledPage(b byte) []byte {
+	return bytes.Repeat([]byte{b}, DefaultPageSize)
+}
+
+func Test_FaultDiskManagerNthFaults(t *testing.T) {
+	disk := newFaultDisk(t, 1)
+	assert.NoError(t, disk.WritePage(0, filledPage(1)))
+
+	buf := make([]byte, DefaultPageSize)
+	disk.FailRead(2)
+	assert.NoError(t, disk.ReadPage(0, buf))
+	assert.ErrorIs(t, disk.ReadPage(0, buf), ErrInjectedFault)
+	assert.NoError(t, disk.ReadPage(0, buf))
+	assert.Equal(t, 3, disk.Reads())
+
+	// a failed write leaves the page alone
+	disk.FailWrite(1)
+	assert.ErrorIs(t, disk.WritePage(0, filledPage(2)), ErrInjectedFault)
+	assert.NoError(t, disk.ReadPage(0, buf))
+	assert.Equal(t, filledPage(1), buf)
+
+	// a torn write stores whole leading sectors of the new content
+	disk.TearWrite(1)
+	assert.ErrorIs(t, disk.WritePage(0, filledPage(3)), ErrInjectedFault)
+	assert.NoError(t, disk.ReadPage(0, buf))
+	written := bytes.IndexByte(buf, 1)
+	assert.Greater(t, written, 0)
+	assert.Zero(t, written%sectorSize)
+	assert.Equal(t, filledPage(3)[:written], buf[:written])
+	assert.Equal(t, filledPage(1)[written:], buf[written:])
+	assert.Equal(t, 3, disk.Writes())
+}
+
+func Test_FaultDiskManagerCrashDropsUnsyncedWrites(t *testing.T) {
+	disk := newFaultDisk(t, 1)
+	pageID, err := disk.AllocatePage(1, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, disk.WritePage(int64(pageID), filledPage(1)))
+	assert.NoError(t, disk.Sync())
+
+	pageID, err = disk.AllocatePage(1, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, disk.WritePage(0, filledPage(2)))
+	assert.NoError(t, disk.WritePage(int64(pageID), filledPage(2)))
+	disk.FailWrite(1)
+
+	restarted := disk.Crash(CrashDropAll)
+	buf := make([]byte, DefaultPageSize)
+	assert.ErrorIs(t, disk.ReadPage(0, buf), ErrCrashed)
+	assert.ErrorIs(t, disk.WritePage(0, buf), ErrCrashed)
+	assert.ErrorIs(t, disk.Sync(), ErrCrashed)
+
+	assert.NoError(t, restarted.ReadPage(0, buf))
+	assert.Equal(t, filledPage(1), buf)
+	assert.ErrorIs(t, restarted.ReadPage(1, buf), io.EOF)
+	assert.True(t, restarted.IsAllocated(0))
+	assert.False(t, restarted.IsAllocated(1))
+	// faults scheduled before the crash are gone
+	assert.NoError(t, restarted.WritePage(1, filledPage(3)))
+}
+
+func Test_FaultDiskManagerCrashRandomReplays(t *testing.T) {
+	run := func(seed int64) map[int64][]byte {
+		disk := newFaultDisk(t, seed)
+		for pageID := int64(0); pageID < 32; pageID++ {
+			assert.NoError(t, disk.WritePage(pageID, filledPage(1)))
+		}
+		assert.NoError(t, disk.Sync())
+		for pageID := int64(0); pageID < 32; pageID++ {
+			assert.NoError(t, disk.WritePage(pageID, filledPage(2)))
+		}
+		return disk.Crash(CrashRandom).durable
+	}
+	pages := run(7)
+	assert.Equal(t, pages, run(7))
+
+	kept, dropped, torn := 0, 0, 0
+	for _, page := range pages {
+		switch {
+		case bytes.Equal(page, filledPage(2)):
+			kept++
+		case bytes.Equal(page, filledPage(1)):
+			dropped++
+		default:
+			torn++
+			assert.Equal(t, byte(2), page[0])
+			assert.Equal(t, byte(1), page[DefaultPageSize-1])
+		}
+	}
+	assert.Equal(t, 32, kept+dropped+torn)
+	assert.NotZero(t, kept)
+	assert.NotZero(t, dropped)
+	assert.NotZero(t, torn)
+}
+
+func Test_BPMSurvivesInjectedFaults(t *testing.T) {
+	disk := newFaultDisk(t, 1)
+	bpm := NewBufferPool(1, disk)
+	p, err := bpm.NewPage()
+	assert.NoError(t, err)
+	p.GetData()[0] = 1
+	assert.True(t, bpm.UnpinPage(0, true))
+
+	// write back of the dirty victim fails, the page stays resident and dirty
+	disk.FailWrite(1)
+	_, err = bpm.NewPage()
+	assert.ErrorIs(t, err, ErrInjectedFault)
+	assert.Equal(t, []FrameInfo{{FrameID: 0, PageID: 0, Dirty: true}}, bpm.Frames())
+
+	p, err = bpm.NewPage()
+	assert.NoError(t, err)
+	assert.True(t, bpm.UnpinPage(p.GetPageID(), false))
+
+	// a failed read does not leave the page behind
+	disk.FailRead(1)
+	_, err = bpm.FetchPage(0)
+	assert.ErrorIs(t, err, ErrInjectedFault)
+	p, err = bpm.FetchPage(0)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(1), p.GetData()[0])
+	assert.True(t, bpm.UnpinPage(0, false))
+	assert.NoError(t, bpm.Close())
+}
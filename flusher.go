@@ -0,0 +1,106 @@
+package buff
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// backgroundFlusher writes unpinned dirty frames back to disk outside of
+// NewPage/FetchPage, so that victims are usually clean when they are evicted
+type backgroundFlusher struct {
+	interval   time.Duration
+	dirtyRatio float64
+	wake       chan struct{}
+	stop       chan struct{}
+	done       chan struct{}
+	stopOnce   *sync.Once
+}
+
+// WithBackgroundFlusher starts a goroutine that flushes every unpinned dirty page
+// once the fraction of dirty frames reaches dirtyRatio. The ratio is checked
+// every interval and whenever a page is unpinned dirty. The goroutine is stopped by Close.
+// It panics if interval is not positive, like time.NewTicker would
+func WithBackgroundFlusher(interval time.Duration, dirtyRatio float64) Option {
+	if interval <= 0 {
+		panic(fmt.Sprintf("background flusher interval must be positive, got %v", interval))
+	}
+	return func(b *BufferPool) {
+		b.flusher = &backgroundFlusher{
+			interval:   interval,
+			dirtyRatio: dirtyRatio,
+			wake:       make(chan struct{}, 1),
+			stop:       make(chan struct{}),
+			done:       make(chan struct{}),
+			stopOnce:   &sync.Once{},
+		}
+	}
+}
+
+func (b *BufferPool) runFlusher() {
+	f := b.flusher
+	defer close(f.done)
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+		case <-f.wake:
+		}
+		b.flushDirtyFrames()
+	}
+}
+
+// stopFlusher waits for the background flusher to exit, it is a no-op
+// if the flusher is not enabled or has already been stopped
+func (b *BufferPool) stopFlusher() {
+	f := b.flusher
+	if f == nil {
+		return
+	}
+	f.stopOnce.Do(func() {
+		close(f.stop)
+	})
+	<-f.done
+}
+
+func (b *BufferPool) lockedDirtyRatioReached() bool {
+	return b.dirtyPages > 0 && float64(b.dirtyPages) >= b.flusher.dirtyRatio*float64(b.size)
+}
+
+// lockedWakeFlusher is called when a page becomes dirty, it never blocks
+func (b *BufferPool) lockedWakeFlusher() {
+	if b.flusher == nil || !b.lockedDirtyRatioReached() {
+		return
+	}
+	select {
+	case b.flusher.wake <- struct{}{}:
+	default:
+	}
+}
+
+// flushDirtyFrames writes back unpinned dirty pages when the dirty ratio is reached,
+// a failed write leaves the page dirty, it will be retried by the next round,
+// by eviction or by Close which reports the error
+func (b *BufferPool) flushDirtyFrames() {
+	var pageIDs []int
+	locked(b.mu, func() {
+		if !b.lockedDirtyRatioReached() {
+			return
+		}
+		for pageID, page := range b.pageTable {
+			if page.dirty && page.pinCount == 0 {
+				pageIDs = append(pageIDs, pageID)
+			}
+		}
+	})
+	sort.Ints(pageIDs)
+	for _, pageID := range pageIDs {
+		if b.FlushPage(pageID) == nil {
+			incr(&b.counters.backgroundFlushes)
+		}
+	}
+}
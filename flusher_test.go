@@ -0,0 +1,113 @@
+package buff
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func countDirtyFrames(bpm *BufferPool) int {
+	dirty := 0
+	for _, f := range bpm.Frames() {
+		if f.Dirty {
+			dirty++
+		}
+	}
+	return dirty
+}
+
+func Test_BackgroundFlusherCleansUnpinnedPages(t *testing.T) {
+	disk, err := NewDiskManager(testDBFile(t))
+	assert.NoError(t, err)
+	poolSize := 4
+	bpm := NewBufferPool(poolSize, disk, WithBackgroundFlusher(time.Hour, 0.5))
+
+	for i := 0; i < poolSize; i++ {
+		_, err := bpm.NewPage()
+		assert.NoError(t, err)
+	}
+	// below the ratio, nothing is flushed
+	assert.True(t, bpm.UnpinPage(0, true))
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 1, countDirtyFrames(bpm))
+
+	// reaching the ratio wakes the flusher up, pinned dirty page 2 is left alone
+	assert.True(t, bpm.UnpinPage(1, true))
+	assert.True(t, bpm.UnpinPage(2, true))
+	_, err = bpm.FetchPage(2)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return countDirtyFrames(bpm) == 1
+	}, time.Second, time.Millisecond)
+	for _, f := range bpm.Frames() {
+		assert.Equal(t, f.PageID == 2, f.Dirty)
+	}
+	assert.Equal(t, uint64(2), bpm.Stats().BackgroundFlushes)
+
+	// victims are clean now, eviction does not write
+	writes := bpm.Stats().DiskWrites
+	_, err = bpm.NewPage()
+	assert.NoError(t, err)
+	assert.Equal(t, writes, bpm.Stats().DiskWrites)
+
+	for _, pageID := range []int{2, 3, 4} {
+		assert.True(t, bpm.UnpinPage(pageID, false))
+	}
+	assert.NoError(t, bpm.Close())
+	select {
+	case <-bpm.flusher.done:
+	default:
+		t.Fatal("flusher is still running after Close")
+	}
+}
+
+func Test_BackgroundFlusherInterval(t *testing.T) {
+	disk, err := NewDiskManager(testDBFile(t))
+	assert.NoError(t, err)
+	bpm := NewParallelBufferPool(2, 4, disk, WithBackgroundFlusher(time.Millisecond, 0))
+
+	for i := 0; i < 4; i++ {
+		p, err := bpm.NewPage()
+		assert.NoError(t, err)
+		p.GetData()[0] = byte(i)
+		assert.True(t, bpm.UnpinPage(p.GetPageID(), true))
+	}
+	assert.Eventually(t, func() bool {
+		return bpm.Stats().BackgroundFlushes == 4
+	}, time.Second, time.Millisecond)
+	assert.NoError(t, bpm.Close())
+}
+
+func Test_BackgroundFlusherCountsDirtyPages(t *testing.T) {
+	assert.Panics(t, func() { WithBackgroundFlusher(0, 0.5) })
+
+	disk, err := NewDiskManager(testDBFile(t))
+	assert.NoError(t, err)
+	bpm := NewBufferPool(3, disk, WithBackgroundFlusher(time.Hour, 1))
+	for i := 0; i < 3; i++ {
+		_, err := bpm.NewPage()
+		assert.NoError(t, err)
+		assert.True(t, bpm.UnpinPage(i, true))
+	}
+	// the ratio of 1 is reached only with every frame dirty
+	assert.Eventually(t, func() bool {
+		return bpm.Stats().BackgroundFlushes == 3
+	}, time.Second, time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		_, err := bpm.FetchPage(i)
+		assert.NoError(t, err)
+		assert.True(t, bpm.UnpinPage(i, true))
+	}
+	assert.True(t, bpm.DeletePage(1))
+	assert.Equal(t, 1, countDirtyFrames(bpm))
+	locked(bpm.mu, func() {
+		assert.Equal(t, 1, bpm.dirtyPages)
+	})
+	assert.NoError(t, bpm.FlushPage(0))
+	locked(bpm.mu, func() {
+		assert.Equal(t, 0, bpm.dirtyPages)
+	})
+	assert.NoError(t, bpm.Close())
+}
@@ -0,0 +1,141 @@
+package buff
+
+import (
+	"fmt"
+)
+
+// allocMap is a set of allocation bitmap pages, one bit per page id.
+// It is not safe for concurrent use, callers serialize access
+type allocMap struct {
+	pageSize int
+	// bitmap pages indexed by group
+	maps [][]byte
+	// persist writes one bitmap page through to storage, may be nil
+	persist func(group int, bitmap []byte) error
+	// where allocate starts looking for each shard, every id of the shard below it is allocated
+	hints map[allocShard]int
+}
+
+// allocShard is the set of page ids satisfying pageID % stride == offset
+type allocShard struct {
+	stride, offset int
+}
+
+func newAllocMap(pageSize int, persist func(group int, bitmap []byte) error) *allocMap {
+	return &allocMap{pageSize: pageSize, persist: persist, hints: make(map[allocShard]int)}
+}
+
+// bitsPerMap is the number of page ids tracked by one bitmap page
+func (a *allocMap) bitsPerMap() int {
+	return a.pageSize * 8
+}
+
+// allocate only hands out page ids satisfying pageID % stride == offset,
+// so that each ParallelBufferPool instance allocates ids it owns
+func (a *allocMap) allocate(stride, offset int) (int, error) {
+	shard := allocShard{stride: stride, offset: offset}
+	pageID, ok := a.hints[shard]
+	if !ok {
+		pageID = offset
+	}
+	for pageID < len(a.maps)*a.bitsPerMap() && a.isAllocated(pageID) {
+		pageID += stride
+	}
+	if err := a.set(pageID, true); err != nil {
+		a.hints[shard] = pageID
+		return 0, err
+	}
+	a.hints[shard] = pageID + stride
+	return pageID, nil
+}
+
+func (a *allocMap) deallocate(pageID int) error {
+	if !a.isAllocated(pageID) {
+		return fmt.Errorf("page %d is not allocated", pageID)
+	}
+	if err := a.set(pageID, false); err != nil {
+		return err
+	}
+	for shard, hint := range a.hints {
+		if pageID < hint && pageID%shard.stride == shard.offset {
+			a.hints[shard] = pageID
+		}
+	}
+	return nil
+}
+
+func (a *allocMap) isAllocated(pageID int) bool {
+	group, bit := pageID/a.bitsPerMap(), pageID%a.bitsPerMap()
+	if pageID < 0 || group >= len(a.maps) {
+		return false
+	}
+	return a.maps[group][bit/8]&(1<<(bit%8)) != 0
+}
+
+// set updates the bitmap and persists it, the in memory bitmap is restored if that fails
+func (a *allocMap) set(pageID int, allocated bool) error {
+	group, bit := pageID/a.bitsPerMap(), pageID%a.bitsPerMap()
+	for len(a.maps) <= group {
+		a.maps = append(a.maps, make([]byte, a.pageSize))
+	}
+	bitmap := a.maps[group]
+	prev := bitmap[bit/8]
+	if allocated {
+		bitmap[bit/8] |= 1 << (bit % 8)
+	} else {
+		bitmap[bit/8] &^= 1 << (bit % 8)
+	}
+	if a.persist == nil {
+		return nil
+	}
+	if err := a.persist(group, bitmap); err != nil {
+		bitmap[bit/8] = prev
+		return fmt.Errorf("failed to write bitmap of group %d: %w", group, err)
+	}
+	return nil
+}
+
+func (d *FileDiskManager) loadAllocMaps() error {
+	info, err := d.f.Stat()
+	if err != nil {
+		return err
+	}
+	// the header is the only page of a new file
+	if info.Size() <= int64(d.pageSize) {
+		return nil
+	}
+	numGroups := int((info.Size()-int64(d.pageSize)-1)/d.groupSize()) + 1
+	d.alloc.maps = make([][]byte, numGroups)
+	for group := range d.alloc.maps {
+		bitmap := make([]byte, d.pageSize)
+		if err := d.readAt(d.mapPageOffset(group), bitmap); err != nil {
+			return fmt.Errorf("failed to read bitmap of group %d: %w", group, err)
+		}
+		d.alloc.maps[group] = bitmap
+	}
+	return nil
+}
+
+func (d *FileDiskManager) writeAllocMap(group int, bitmap []byte) error {
+	return d.writeAt(d.mapPageOffset(group), bitmap)
+}
+
+func (d *FileDiskManager) AllocatePage(numShards, shard int) (int, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.alloc.allocate(numShards, shard)
+}
+
+// DeallocatePage marks pageID as free, its content on disk is left untouched
+// and will be overwritten once the id is reused
+func (d *FileDiskManager) DeallocatePage(pageID int) error {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.alloc.deallocate(pageID)
+}
+
+func (d *FileDiskManager) IsAllocated(pageID int) bool {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.alloc.isAllocated(pageID)
+}
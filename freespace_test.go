@@ -0,0 +1,27 @@
+package buff
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_AllocMapReusesLowestFreeIDPerShard(t *testing.T) {
+	a := newAllocMap(MinPageSize, nil)
+	for i := 0; i < 6; i++ {
+		pageID, err := a.allocate(2, i%2)
+		assert.NoError(t, err)
+		assert.Equal(t, i, pageID)
+	}
+	assert.NoError(t, a.deallocate(3))
+	assert.NoError(t, a.deallocate(1))
+	assert.NoError(t, a.deallocate(4))
+	assert.Error(t, a.deallocate(4))
+
+	// each shard gets its lowest free id back first, then new ids
+	for _, expect := range [][2]int{{1, 1}, {0, 4}, {1, 3}, {1, 7}, {0, 6}} {
+		pageID, err := a.allocate(2, expect[0])
+		assert.NoError(t, err)
+		assert.Equal(t, expect[1], pageID)
+	}
+}
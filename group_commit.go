@@ -0,0 +1,82 @@
+package buff
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// SyncMode decides when written pages are forced to stable storage
+type SyncMode int
+
+const (
+	// SyncPerWrite makes every page write durable before it returns
+	SyncPerWrite SyncMode = iota
+	// SyncBatched leaves writes in the OS cache until Sync is called,
+	// concurrent Sync calls are coalesced into as few fsyncs as possible
+	SyncBatched
+)
+
+// WithSyncMode applies to FileDiskManager
+func WithSyncMode(mode SyncMode) DiskOption {
+	return func(c *diskConfig) {
+		c.syncMode = mode
+	}
+}
+
+// groupCommit coalesces fsync requests: a caller of Sync waits for the first fsync that
+// starts after its call, and at most one fsync is in flight at a time
+type groupCommit struct {
+	mu      *sync.Mutex
+	cond    *sync.Cond
+	syncing bool
+	// number of completed writes, and the number of writes covered by the last fsync
+	written uint64
+	synced  uint64
+	// number of fsync calls issued
+	fsyncs uint64
+}
+
+func newGroupCommit() *groupCommit {
+	mu := &sync.Mutex{}
+	return &groupCommit{
+		mu:   mu,
+		cond: sync.NewCond(mu),
+	}
+}
+
+func (d *FileDiskManager) afterWrite() error {
+	atomic.AddUint64(&d.commit.written, 1)
+	if d.syncMode == SyncPerWrite {
+		return d.Sync()
+	}
+	return nil
+}
+
+// Sync coalesces concurrent callers into as few fsyncs as possible
+func (d *FileDiskManager) Sync() error {
+	g := d.commit
+	target := atomic.LoadUint64(&g.written)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.synced < target {
+		if g.syncing {
+			g.cond.Wait()
+			continue
+		}
+		g.syncing = true
+		covered := atomic.LoadUint64(&g.written)
+		g.mu.Unlock()
+		atomic.AddUint64(&g.fsyncs, 1)
+		err := d.f.Sync()
+		g.mu.Lock()
+		g.syncing = false
+		g.cond.Broadcast()
+		if err != nil {
+			return err
+		}
+		if covered > g.synced {
+			g.synced = covered
+		}
+	}
+	return nil
+}
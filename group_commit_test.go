@@ -0,0 +1,77 @@
+package buff
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_DiskManagerSyncPerWrite(t *testing.T) {
+	disk, err := NewDiskManager(testDBFile(t))
+	assert.NoError(t, err)
+	data := make([]byte, DefaultPageSize)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, disk.WritePage(int64(i), data))
+	}
+	assert.Equal(t, uint64(3), atomic.LoadUint64(&disk.commit.fsyncs))
+	// nothing new to sync
+	assert.NoError(t, disk.Sync())
+	assert.Equal(t, uint64(3), atomic.LoadUint64(&disk.commit.fsyncs))
+	assert.NoError(t, disk.Close())
+}
+
+func Test_DiskManagerSyncBatched(t *testing.T) {
+	file := testDBFile(t)
+	disk, err := NewDiskManager(file, WithSyncMode(SyncBatched))
+	assert.NoError(t, err)
+	data := make([]byte, DefaultPageSize)
+	for i := 0; i < 10; i++ {
+		data[0] = byte(i)
+		assert.NoError(t, disk.WritePage(int64(i), data))
+	}
+	assert.Equal(t, uint64(0), atomic.LoadUint64(&disk.commit.fsyncs))
+	assert.NoError(t, disk.Sync())
+	assert.NoError(t, disk.Sync())
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&disk.commit.fsyncs))
+
+	var (
+		wg      sync.WaitGroup
+		writers = 16
+	)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			buf := make([]byte, DefaultPageSize)
+			buf[0] = byte(w)
+			assert.NoError(t, disk.WritePage(int64(w), buf))
+			assert.NoError(t, disk.Sync())
+		}(w)
+	}
+	wg.Wait()
+	fsyncs := atomic.LoadUint64(&disk.commit.fsyncs) - 1
+	assert.LessOrEqual(t, fsyncs, uint64(writers))
+	assert.Equal(t, atomic.LoadUint64(&disk.commit.written), disk.commit.synced)
+	assert.NoError(t, disk.Close())
+}
+
+func Test_BPMSyncWithBatchedDisk(t *testing.T) {
+	file := testDBFile(t)
+	disk, err := NewDiskManager(file, WithSyncMode(SyncBatched))
+	assert.NoError(t, err)
+	bpm := NewBufferPool(4, disk)
+	for i := 0; i < 4; i++ {
+		p, err := bpm.NewPage()
+		assert.NoError(t, err)
+		p.GetData()[0] = byte(i + 1)
+		assert.True(t, bpm.UnpinPage(i, true))
+	}
+	assert.NoError(t, bpm.Sync())
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&disk.commit.fsyncs))
+	for _, f := range bpm.Frames() {
+		assert.False(t, f.Dirty)
+	}
+	assert.NoError(t, bpm.Close())
+}
@@ -0,0 +1,120 @@
+package buff
+
+import (
+	"sync"
+)
+
+// LRUKReplacer evicts the frame whose backward k-distance is the largest,
+// the backward k-distance is the difference between current timestamp and the
+// timestamp of kth previous access. Frames with less than k recorded accesses
+// have +inf distance, ties among them are broken by their earliest access (classic LRU)
+type LRUKReplacer struct {
+	mu        *sync.Mutex
+	k         int
+	now       int64
+	evictable int
+	frames    map[int]*lruKFrame
+}
+
+type lruKFrame struct {
+	// most recent k access timestamps, oldest first
+	history     []int64
+	isEvictable bool
+}
+
+func NewLRUKReplacer(numPage int, k int) *LRUKReplacer {
+	if k < 1 {
+		panic("k must be at least 1")
+	}
+	return &LRUKReplacer{
+		mu:     &sync.Mutex{},
+		k:      k,
+		frames: make(map[int]*lruKFrame, numPage),
+	}
+}
+
+func (r *LRUKReplacer) lockedGetFrame(frameID int) *lruKFrame {
+	f, ok := r.frames[frameID]
+	if !ok {
+		f = &lruKFrame{
+			history: make([]int64, 0, r.k),
+		}
+		r.frames[frameID] = f
+	}
+	return f
+}
+
+func (r *LRUKReplacer) RecordAccess(frameID int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f := r.lockedGetFrame(frameID)
+	r.now++
+	if len(f.history) == r.k {
+		copy(f.history, f.history[1:])
+		f.history = f.history[:r.k-1]
+	}
+	f.history = append(f.history, r.now)
+}
+
+func (r *LRUKReplacer) Victim() (int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var (
+		victim     = -1
+		victimInf  bool
+		victimTime int64
+	)
+	for frameID, f := range r.frames {
+		if !f.isEvictable {
+			continue
+		}
+		// oldest tracked access, for a full history it is the kth previous access
+		var oldest int64
+		if len(f.history) > 0 {
+			oldest = f.history[0]
+		}
+		isInf := len(f.history) < r.k
+		// larger k-distance means older kth access, +inf always wins over finite distance
+		better := victim == -1 ||
+			(isInf && !victimInf) ||
+			(isInf == victimInf && oldest < victimTime) ||
+			(isInf == victimInf && oldest == victimTime && frameID < victim)
+		if better {
+			victim, victimInf, victimTime = frameID, isInf, oldest
+		}
+	}
+	if victim == -1 {
+		return 0, false
+	}
+	delete(r.frames, victim)
+	r.evictable--
+	return victim, true
+}
+
+func (r *LRUKReplacer) Pin(frameID int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, ok := r.frames[frameID]
+	if !ok || !f.isEvictable {
+		return
+	}
+	f.isEvictable = false
+	r.evictable--
+}
+
+func (r *LRUKReplacer) Unpin(frameID int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f := r.lockedGetFrame(frameID)
+	if f.isEvictable {
+		return
+	}
+	f.isEvictable = true
+	r.evictable++
+}
+
+func (r *LRUKReplacer) Size() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.evictable
+}
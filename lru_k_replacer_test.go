@@ -0,0 +1,81 @@
+package buff
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_LRUKReplacer(t *testing.T) {
+	r := NewLRUKReplacer(7, 2)
+	for i := 1; i <= 6; i++ {
+		r.RecordAccess(i)
+		r.Unpin(i)
+	}
+	// frame 1 now has 2 accesses, every other frame has +inf k-distance
+	r.RecordAccess(1)
+	assert.Equal(t, 6, r.Size())
+
+	var (
+		evictedFrame int
+		evicted      bool
+	)
+	evictedFrame, evicted = r.Victim()
+	assert.True(t, evicted)
+	assert.Equal(t, 2, evictedFrame)
+
+	evictedFrame, evicted = r.Victim()
+	assert.True(t, evicted)
+	assert.Equal(t, 3, evictedFrame)
+
+	evictedFrame, evicted = r.Victim()
+	assert.True(t, evicted)
+	assert.Equal(t, 4, evictedFrame)
+	assert.Equal(t, 3, r.Size())
+
+	// 5 and 6 reach k accesses, 5's second to last access is older than 6's
+	r.RecordAccess(5)
+	r.RecordAccess(6)
+	r.Pin(1)
+	assert.Equal(t, 2, r.Size())
+
+	evictedFrame, evicted = r.Victim()
+	assert.True(t, evicted)
+	assert.Equal(t, 5, evictedFrame)
+
+	r.Unpin(1)
+	evictedFrame, evicted = r.Victim()
+	assert.True(t, evicted)
+	assert.Equal(t, 1, evictedFrame)
+
+	evictedFrame, evicted = r.Victim()
+	assert.True(t, evicted)
+	assert.Equal(t, 6, evictedFrame)
+
+	_, evicted = r.Victim()
+	assert.False(t, evicted)
+	assert.Equal(t, 0, r.Size())
+}
+
+// a sequential scan touching many pages once must not evict a hot page
+func Test_BPMLRUKScanResistance(t *testing.T) {
+	disk, err := NewDiskManager(testDBFile(t))
+	assert.NoError(t, err)
+	poolSize := 3
+	bpm := NewBufferPool(poolSize, disk, WithReplacer(NewLRUKReplacer(poolSize, 2)))
+
+	hot, err := bpm.NewPage()
+	assert.NoError(t, err)
+	bpm.UnpinPage(hot.GetPageID(), true)
+	page, err := bpm.FetchPage(hot.GetPageID())
+	assert.NoError(t, err)
+	assert.Equal(t, hot, page)
+	bpm.UnpinPage(hot.GetPageID(), true)
+
+	for i := 0; i < 10; i++ {
+		p, err := bpm.NewPage()
+		assert.NoError(t, err)
+		assert.NotEqual(t, hot.frameID, p.frameID)
+		bpm.UnpinPage(p.GetPageID(), true)
+	}
+}
@@ -0,0 +1,605 @@
+package buff
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// MappedDiskManager stores every page encoded by a PageCodec, so that pages take a
+// variable amount of space on disk. Pages are written copy-on-write to extents of whole
+// sectors, and a page map translates page ids to extents. The page map and the allocation
+// bitmaps are written as a checkpoint on Sync; a crash, or a Close without Sync, goes back
+// to the last checkpoint. File layout:
+//
+//	| superblock 0 | superblock 1 | extents ...
+//
+// Superblocks are written alternately, on open the valid one with the highest generation wins,
+// they also record the page size.
+// Every page write gets a sequence number that is never reused for the file, even across
+// crashes, so that codecs can derive nonces from it. A new file starts from a random number
+type MappedDiskManager struct {
+	m        *sync.Mutex
+	f        *os.File
+	pageSize int
+	codec    PageCodec
+	alloc    *allocMap
+	pages    map[int64]extent
+	// free spans sorted by start, adjacent spans are merged
+	free []span
+	// extents replaced since the last checkpoint, still referenced by it
+	released []extent
+	// first sector after the last extent
+	end        int64
+	generation uint64
+	checkpoint extent
+	// next write sequence number, and the limit recorded by the superblock
+	seq      uint64
+	seqLimit uint64
+}
+
+// span is a run of sectors
+type span struct {
+	start   int64
+	sectors int64
+}
+
+// extent holds length bytes starting at sector start
+type extent struct {
+	start  int64
+	length int64
+}
+
+func (e extent) span() span {
+	return span{e.start, (e.length + sectorSize - 1) / sectorSize}
+}
+
+const (
+	superblockMagic = "BUFFMAP1"
+	// magic, generation, checkpoint start and length, sequence limit, page size, crc
+	superblockSize = 8 + 8 + 8 + 8 + 8 + 4 + 4
+	// the superblocks take the first sector each
+	firstExtentSector = 2
+)
+
+var (
+	errNoSuperblock = errors.New("no valid superblock")
+	errNeverSynced  = errors.New("no superblock has been written")
+)
+
+// NewMappedDiskManager only uses WithPageSize
+func NewMappedDiskManager(filename string, codec PageCodec, opts ...DiskOption) (*MappedDiskManager, error) {
+	cfg := newDiskConfig(opts)
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file %s: %w", filename, err)
+	}
+	d := &MappedDiskManager{
+		m:     &sync.Mutex{},
+		f:     file,
+		codec: codec,
+		pages: map[int64]extent{},
+		end:   firstExtentSector,
+	}
+	if err := d.load(cfg.pageSize); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to load page map of %s: %w", filename, err)
+	}
+	return d, nil
+}
+
+// load reads the last checkpoint, every sector it does not reference is free.
+// pageSize is the size asked for by the caller, 0 if any
+func (d *MappedDiskManager) load(pageSize int) error {
+	info, err := d.f.Stat()
+	if err != nil {
+		return err
+	}
+	sb, err := superblock{}, errNeverSynced
+	if info.Size() > 0 {
+		sb, err = d.readSuperblocks()
+	}
+	if errors.Is(err, errNeverSynced) {
+		// a new file, extents written before the first superblock are garbage
+		if pageSize == 0 {
+			pageSize = DefaultPageSize
+		}
+		if err := checkPageSize(pageSize); err != nil {
+			return err
+		}
+		d.pageSize = pageSize
+		d.alloc = newAllocMap(pageSize, nil)
+		seq, err := randomSeq()
+		if err != nil {
+			return err
+		}
+		d.seq, d.seqLimit = seq, seq
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := checkPageSize(sb.pageSize); err != nil {
+		return err
+	}
+	if pageSize != 0 && pageSize != sb.pageSize {
+		return fmt.Errorf("file has page size %d, expect %d: %w", sb.pageSize, pageSize, ErrPageSizeMismatch)
+	}
+	d.pageSize = sb.pageSize
+	d.alloc = newAllocMap(sb.pageSize, nil)
+	d.generation, d.checkpoint = sb.generation, sb.checkpoint
+	// numbers below the limit may have been used before a crash
+	d.seq, d.seqLimit = sb.seqLimit, sb.seqLimit
+	if sb.checkpoint.length == 0 {
+		// only sequence numbers have been reserved so far
+		return nil
+	}
+	data := make([]byte, sb.checkpoint.length)
+	if _, err := d.f.ReadAt(data, sb.checkpoint.start*sectorSize); err != nil {
+		return fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	if err := d.decodeCheckpoint(data); err != nil {
+		return err
+	}
+
+	used := []span{d.checkpoint.span()}
+	for _, e := range d.pages {
+		used = append(used, e.span())
+	}
+	sort.Slice(used, func(i, j int) bool { return used[i].start < used[j].start })
+	for _, s := range used {
+		if s.start > d.end {
+			d.free = append(d.free, span{d.end, s.start - d.end})
+		}
+		if s.start+s.sectors > d.end {
+			d.end = s.start + s.sectors
+		}
+	}
+	return nil
+}
+
+type superblock struct {
+	generation uint64
+	checkpoint extent
+	seqLimit   uint64
+	pageSize   int
+}
+
+func (d *MappedDiskManager) readSuperblocks() (superblock, error) {
+	var (
+		best    superblock
+		found   bool
+		written bool
+	)
+	buf := make([]byte, superblockSize)
+	for slot := int64(0); slot < 2; slot++ {
+		if _, err := d.f.ReadAt(buf, slot*sectorSize); err != nil {
+			continue
+		}
+		written = written || string(buf[:8]) == superblockMagic
+		sb, ok := decodeSuperblock(buf)
+		if ok && (!found || sb.generation > best.generation) {
+			best, found = sb, true
+		}
+	}
+	switch {
+	case found:
+		return best, nil
+	case written:
+		return best, errNoSuperblock
+	}
+	return best, errNeverSynced
+}
+
+func encodeSuperblock(sb superblock) []byte {
+	buf := make([]byte, superblockSize)
+	copy(buf, superblockMagic)
+	binary.LittleEndian.PutUint64(buf[8:], sb.generation)
+	binary.LittleEndian.PutUint64(buf[16:], uint64(sb.checkpoint.start))
+	binary.LittleEndian.PutUint64(buf[24:], uint64(sb.checkpoint.length))
+	binary.LittleEndian.PutUint64(buf[32:], sb.seqLimit)
+	binary.LittleEndian.PutUint32(buf[40:], uint32(sb.pageSize))
+	binary.LittleEndian.PutUint32(buf[44:], crc32.Checksum(buf[:44], castagnoli))
+	return buf
+}
+
+func decodeSuperblock(buf []byte) (superblock, bool) {
+	if string(buf[:8]) != superblockMagic ||
+		binary.LittleEndian.Uint32(buf[44:]) != crc32.Checksum(buf[:44], castagnoli) {
+		return superblock{}, false
+	}
+	return superblock{
+		generation: binary.LittleEndian.Uint64(buf[8:]),
+		checkpoint: extent{
+			start:  int64(binary.LittleEndian.Uint64(buf[16:])),
+			length: int64(binary.LittleEndian.Uint64(buf[24:])),
+		},
+		seqLimit: binary.LittleEndian.Uint64(buf[32:]),
+		pageSize: int(binary.LittleEndian.Uint32(buf[40:])),
+	}, true
+}
+
+// lockedEncodeCheckpoint serializes the allocation bitmaps and the page map:
+//
+//	| #bitmaps | bitmaps | #pages | (page id, start, length)... | crc32c |
+func (d *MappedDiskManager) lockedEncodeCheckpoint() []byte {
+	buf := appendUvarint(nil, uint64(len(d.alloc.maps)))
+	for _, bitmap := range d.alloc.maps {
+		buf = append(buf, bitmap...)
+	}
+	pageIDs := make([]int64, 0, len(d.pages))
+	for pageID := range d.pages {
+		pageIDs = append(pageIDs, pageID)
+	}
+	sort.Slice(pageIDs, func(i, j int) bool { return pageIDs[i] < pageIDs[j] })
+	buf = appendUvarint(buf, uint64(len(pageIDs)))
+	for _, pageID := range pageIDs {
+		e := d.pages[pageID]
+		buf = appendUvarint(buf, uint64(pageID))
+		buf = appendUvarint(buf, uint64(e.start))
+		buf = appendUvarint(buf, uint64(e.length))
+	}
+	crc := make([]byte, 4)
+	binary.LittleEndian.PutUint32(crc, crc32.Checksum(buf, castagnoli))
+	return append(buf, crc...)
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(scratch[:], v)
+	return append(buf, scratch[:n]...)
+}
+
+func (d *MappedDiskManager) decodeCheckpoint(data []byte) error {
+	if len(data) < 4 {
+		return fmt.Errorf("checkpoint of %d bytes is too short", len(data))
+	}
+	body := data[:len(data)-4]
+	if binary.LittleEndian.Uint32(data[len(body):]) != crc32.Checksum(body, castagnoli) {
+		return fmt.Errorf("checkpoint checksum mismatch")
+	}
+	r := &uvarintReader{buf: body}
+	numMaps := r.next()
+	for i := uint64(0); i < numMaps && r.err == nil; i++ {
+		d.alloc.maps = append(d.alloc.maps, r.bytes(d.pageSize))
+	}
+	numPages := r.next()
+	for i := uint64(0); i < numPages && r.err == nil; i++ {
+		pageID := int64(r.next())
+		d.pages[pageID] = extent{start: int64(r.next()), length: int64(r.next())}
+	}
+	if r.err != nil {
+		return fmt.Errorf("malformed checkpoint: %w", r.err)
+	}
+	return nil
+}
+
+// uvarintReader keeps the first error, later reads return zero values
+type uvarintReader struct {
+	buf []byte
+	err error
+}
+
+func (r *uvarintReader) next() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *uvarintReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.buf) < n {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	ret := append([]byte(nil), r.buf[:n]...)
+	r.buf = r.buf[n:]
+	return ret
+}
+
+// lockedAllocate returns the first free span of n sectors, growing the file if none fits
+func (d *MappedDiskManager) lockedAllocate(n int64) int64 {
+	for i, s := range d.free {
+		if s.sectors < n {
+			continue
+		}
+		if s.sectors == n {
+			d.free = append(d.free[:i], d.free[i+1:]...)
+		} else {
+			d.free[i] = span{s.start + n, s.sectors - n}
+		}
+		return s.start
+	}
+	start := d.end
+	d.end += n
+	return start
+}
+
+// lockedRelease returns s to the free spans, merging it with its neighbours
+func (d *MappedDiskManager) lockedRelease(s span) {
+	i := sort.Search(len(d.free), func(i int) bool { return d.free[i].start > s.start })
+	d.free = append(d.free, span{})
+	copy(d.free[i+1:], d.free[i:])
+	d.free[i] = s
+	if i+1 < len(d.free) && s.start+s.sectors == d.free[i+1].start {
+		d.free[i].sectors += d.free[i+1].sectors
+		d.free = append(d.free[:i+1], d.free[i+2:]...)
+	}
+	if i > 0 && d.free[i-1].start+d.free[i-1].sectors == s.start {
+		d.free[i-1].sectors += d.free[i].sectors
+		d.free = append(d.free[:i], d.free[i+1:]...)
+	}
+}
+
+// seqReservation is the number of write sequence numbers reserved by one superblock write
+const seqReservation = 1 << 16
+
+// randomSeq returns the first sequence number of a new file, below 2^63 so that
+// the numbers of the file never wrap around
+func randomSeq() (uint64, error) {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return 0, fmt.Errorf("failed to draw a sequence number: %w", err)
+	}
+	return binary.LittleEndian.Uint64(buf[:]) >> 1, nil
+}
+
+// lockedNextSeq hands out write sequence numbers. The superblock records a limit that no
+// number handed out reaches, numbers start again from that limit after a crash, so a
+// number that may have reached the disk is never reused
+func (d *MappedDiskManager) lockedNextSeq() (uint64, error) {
+	if d.seq == d.seqLimit {
+		sb := superblock{
+			generation: d.generation + 1,
+			checkpoint: d.checkpoint,
+			seqLimit:   d.seq + seqReservation,
+			pageSize:   d.pageSize,
+		}
+		if err := d.lockedWriteSuperblock(sb); err != nil {
+			return 0, err
+		}
+		d.generation, d.seqLimit = sb.generation, sb.seqLimit
+	}
+	seq := d.seq
+	d.seq++
+	return seq, nil
+}
+
+func (d *MappedDiskManager) WritePage(pageID int64, data []byte) error {
+	if len(data) != d.pageSize {
+		return fmt.Errorf("buffer provided must have size %d", d.pageSize)
+	}
+	return d.writePage(d.codec, pageID, data)
+}
+
+func (d *MappedDiskManager) writePage(codec PageCodec, pageID int64, data []byte) error {
+	var (
+		seq uint64
+		err error
+	)
+	locked(d.m, func() {
+		seq, err = d.lockedNextSeq()
+	})
+	if err != nil {
+		return err
+	}
+	encoded, err := codec.Encode(pageID, seq, data)
+	if err != nil {
+		return fmt.Errorf("failed to encode page %d: %w", pageID, err)
+	}
+	e := extent{length: int64(len(encoded))}
+	locked(d.m, func() {
+		e.start = d.lockedAllocate(e.span().sectors)
+	})
+	// writes of the same page are ordered by the caller, so the extent can be written unlocked
+	if _, err := d.f.WriteAt(encoded, e.start*sectorSize); err != nil {
+		locked(d.m, func() {
+			d.lockedRelease(e.span())
+		})
+		return err
+	}
+	d.m.Lock()
+	defer d.m.Unlock()
+	if old, ok := d.pages[pageID]; ok {
+		d.released = append(d.released, old)
+	}
+	d.pages[pageID] = e
+	return nil
+}
+
+// ReadPage returns io.EOF if the page has never been written
+func (d *MappedDiskManager) ReadPage(pageID int64, data []byte) error {
+	if len(data) != d.pageSize {
+		return fmt.Errorf("buffer provided must have size %d", d.pageSize)
+	}
+	d.m.Lock()
+	e, ok := d.pages[pageID]
+	d.m.Unlock()
+	if !ok {
+		return io.EOF
+	}
+	encoded := make([]byte, e.length)
+	if _, err := d.f.ReadAt(encoded, e.start*sectorSize); err != nil {
+		return fmt.Errorf("failed to read page %d: %w", pageID, err)
+	}
+	decoded, err := d.codec.Decode(pageID, encoded)
+	if err != nil {
+		return err
+	}
+	if len(decoded) != d.pageSize {
+		return fmt.Errorf("page %d decodes to %d bytes, expect %d", pageID, len(decoded), d.pageSize)
+	}
+	copy(data, decoded)
+	return nil
+}
+
+func (d *MappedDiskManager) PageSize() int {
+	return d.pageSize
+}
+
+func (d *MappedDiskManager) AllocatePage(numShards, shard int) (int, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.alloc.allocate(numShards, shard)
+}
+
+// DeallocatePage also drops the content of pageID, reading it again returns io.EOF
+func (d *MappedDiskManager) DeallocatePage(pageID int) error {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if err := d.alloc.deallocate(pageID); err != nil {
+		return err
+	}
+	if old, ok := d.pages[int64(pageID)]; ok {
+		d.released = append(d.released, old)
+		delete(d.pages, int64(pageID))
+	}
+	return nil
+}
+
+func (d *MappedDiskManager) IsAllocated(pageID int) bool {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.alloc.isAllocated(pageID)
+}
+
+// Sync writes a checkpoint of the page map. Extents replaced since the previous
+// checkpoint are reused only once the new one is durable
+func (d *MappedDiskManager) Sync() error {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.lockedSync()
+}
+
+func (d *MappedDiskManager) lockedSync() error {
+	data := d.lockedEncodeCheckpoint()
+	checkpoint := extent{length: int64(len(data))}
+	checkpoint.start = d.lockedAllocate(checkpoint.span().sectors)
+	sb := superblock{generation: d.generation + 1, checkpoint: checkpoint, seqLimit: d.seqLimit, pageSize: d.pageSize}
+	if err := d.lockedWriteCheckpoint(data, sb); err != nil {
+		d.lockedRelease(checkpoint.span())
+		return err
+	}
+	if d.checkpoint.length > 0 {
+		d.lockedRelease(d.checkpoint.span())
+	}
+	for _, e := range d.released {
+		d.lockedRelease(e.span())
+	}
+	d.released = nil
+	d.generation, d.checkpoint = sb.generation, checkpoint
+	return nil
+}
+
+func (d *MappedDiskManager) lockedWriteCheckpoint(data []byte, sb superblock) error {
+	if _, err := d.f.WriteAt(data, sb.checkpoint.start*sectorSize); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	// extents and checkpoint must be durable before the superblock points to them
+	if err := d.f.Sync(); err != nil {
+		return err
+	}
+	return d.lockedWriteSuperblock(sb)
+}
+
+func (d *MappedDiskManager) lockedWriteSuperblock(sb superblock) error {
+	slot := int64(sb.generation % 2)
+	if _, err := d.f.WriteAt(encodeSuperblock(sb), slot*sectorSize); err != nil {
+		return fmt.Errorf("failed to write superblock: %w", err)
+	}
+	return d.f.Sync()
+}
+
+// Recode rewrites every page with codec and makes it the codec of d, e.g. to rotate an
+// encryption key. The checkpoint written at the end switches every page at once, a crash
+// before it leaves the file readable with the old codec only. The space of the old pages
+// is then zeroed. d must not be used concurrently
+func (d *MappedDiskManager) Recode(codec PageCodec) error {
+	d.m.Lock()
+	old := make(map[int64]extent, len(d.pages))
+	for pageID, e := range d.pages {
+		old[pageID] = e
+	}
+	numReleased := len(d.released)
+	d.m.Unlock()
+
+	pageIDs := make([]int64, 0, len(old))
+	for pageID := range old {
+		pageIDs = append(pageIDs, pageID)
+	}
+	sort.Slice(pageIDs, func(i, j int) bool { return pageIDs[i] < pageIDs[j] })
+	page := make([]byte, d.pageSize)
+	for _, pageID := range pageIDs {
+		err := d.ReadPage(pageID, page)
+		if err == nil {
+			err = d.writePage(codec, pageID, page)
+		}
+		if err != nil {
+			d.m.Lock()
+			defer d.m.Unlock()
+			// extents written so far are not referenced by any checkpoint
+			for pageID, e := range d.pages {
+				if e != old[pageID] {
+					d.lockedRelease(e.span())
+				}
+			}
+			d.pages, d.released = old, d.released[:numReleased]
+			return fmt.Errorf("failed to recode page %d: %w", pageID, err)
+		}
+	}
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.codec = codec
+	if err := d.lockedSync(); err != nil {
+		return err
+	}
+	// nothing encoded by the old codec may be left behind, e.g. pages under a retired key
+	if err := d.lockedScrubFreeSpace(); err != nil {
+		return fmt.Errorf("failed to scrub pages of the old codec: %w", err)
+	}
+	return nil
+}
+
+// lockedScrubFreeSpace overwrites every free span with zeros and cuts the file after the
+// last extent, the latch is held throughout so that no span is reused before it is zeroed
+func (d *MappedDiskManager) lockedScrubFreeSpace() error {
+	zeros := make([]byte, 64*sectorSize)
+	for _, s := range d.free {
+		for offset, end := s.start*sectorSize, (s.start+s.sectors)*sectorSize; offset < end; {
+			n := int64(len(zeros))
+			if end-offset < n {
+				n = end - offset
+			}
+			if _, err := d.f.WriteAt(zeros[:n], offset); err != nil {
+				return err
+			}
+			offset += n
+		}
+	}
+	if err := d.f.Truncate(d.end * sectorSize); err != nil {
+		return err
+	}
+	return d.f.Sync()
+}
+
+// Close does not write a checkpoint, changes since the last Sync are lost
+func (d *MappedDiskManager) Close() error {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.f.Close()
+}
@@ -0,0 +1,199 @@
+package buff
+
+import (
+	"compress/flate"
+	"crypto/rand"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestMappedDisk(t *testing.T, file string) *MappedDiskManager {
+	codec, err := NewFlateCodec(flate.BestSpeed)
+	assert.NoError(t, err)
+	disk, err := NewMappedDiskManager(file, codec)
+	assert.NoError(t, err)
+	return disk
+}
+
+func Test_FlateCodec(t *testing.T) {
+	codec, err := NewFlateCodec(flate.BestSpeed)
+	assert.NoError(t, err)
+	sparse := make([]byte, DefaultPageSize)
+	copy(sparse, "mostly zeros")
+	random := make([]byte, DefaultPageSize)
+	_, err = rand.Read(random)
+	assert.NoError(t, err)
+
+	for _, page := range [][]byte{sparse, random} {
+		encoded, err := codec.Encode(1, 0, page)
+		assert.NoError(t, err)
+		decoded, err := codec.Decode(1, encoded)
+		assert.NoError(t, err)
+		assert.Equal(t, page, decoded)
+	}
+	encoded, err := codec.Encode(1, 0, sparse)
+	assert.NoError(t, err)
+	assert.Less(t, len(encoded), 64)
+	// incompressible pages only grow by the encoding byte
+	encoded, err = codec.Encode(1, 0, random)
+	assert.NoError(t, err)
+	assert.Len(t, encoded, DefaultPageSize+1)
+	encoded, err = codec.Encode(1, 0, sparse)
+	assert.NoError(t, err)
+	_, err = codec.Decode(1, encoded[:len(encoded)/2])
+	assert.Error(t, err)
+}
+
+func Test_MappedDiskManagerCheckpoints(t *testing.T) {
+	file := testDBFile(t)
+	disk := newTestMappedDisk(t, file)
+	buf := make([]byte, DefaultPageSize)
+	assert.ErrorIs(t, disk.ReadPage(0, buf), io.EOF)
+
+	for i := 0; i < 3; i++ {
+		pageID, err := disk.AllocatePage(1, 0)
+		assert.NoError(t, err)
+		buf[0] = byte(i + 1)
+		assert.NoError(t, disk.WritePage(int64(pageID), buf))
+	}
+	assert.NoError(t, disk.ReadPage(1, buf))
+	assert.Equal(t, byte(2), buf[0])
+	assert.NoError(t, disk.Sync())
+
+	// changes after the checkpoint are lost without Sync
+	buf[0] = 9
+	assert.NoError(t, disk.WritePage(1, buf))
+	assert.NoError(t, disk.DeallocatePage(2))
+	assert.ErrorIs(t, disk.ReadPage(2, buf), io.EOF)
+	assert.NoError(t, disk.Close())
+
+	disk = newTestMappedDisk(t, file)
+	for i := 0; i < 3; i++ {
+		assert.True(t, disk.IsAllocated(i))
+		assert.NoError(t, disk.ReadPage(int64(i), buf))
+		assert.Equal(t, byte(i+1), buf[0])
+	}
+	assert.NoError(t, disk.DeallocatePage(2))
+	assert.NoError(t, disk.Sync())
+	assert.NoError(t, disk.Close())
+
+	disk = newTestMappedDisk(t, file)
+	assert.False(t, disk.IsAllocated(2))
+	assert.ErrorIs(t, disk.ReadPage(2, buf), io.EOF)
+	assert.NoError(t, disk.Close())
+}
+
+func Test_MappedDiskManagerReusesSpace(t *testing.T) {
+	file := testDBFile(t)
+	disk := newTestMappedDisk(t, file)
+	page := make([]byte, DefaultPageSize)
+	_, err := rand.Read(page)
+	assert.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		_, err := disk.AllocatePage(1, 0)
+		assert.NoError(t, err)
+		assert.NoError(t, disk.WritePage(int64(i), page))
+	}
+	assert.NoError(t, disk.Sync())
+	info, err := os.Stat(file)
+	assert.NoError(t, err)
+	size := info.Size()
+
+	// rewriting every page over and over does not grow the file without bound
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 4; i++ {
+			assert.NoError(t, disk.WritePage(int64(i), page))
+		}
+		assert.NoError(t, disk.Sync())
+	}
+	info, err = os.Stat(file)
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, info.Size(), 3*size)
+	assert.NoError(t, disk.Close())
+
+	disk = newTestMappedDisk(t, file)
+	read := make([]byte, DefaultPageSize)
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, disk.ReadPage(int64(i), read))
+		assert.Equal(t, page, read)
+	}
+	assert.NoError(t, disk.Close())
+}
+
+func Test_MappedDiskManagerTornSuperblock(t *testing.T) {
+	file := testDBFile(t)
+	disk := newTestMappedDisk(t, file)
+	buf := make([]byte, DefaultPageSize)
+	_, err := disk.AllocatePage(1, 0)
+	assert.NoError(t, err)
+	buf[0] = 1
+	assert.NoError(t, disk.WritePage(0, buf))
+	assert.NoError(t, disk.Sync())
+	buf[0] = 2
+	assert.NoError(t, disk.WritePage(0, buf))
+	assert.NoError(t, disk.Sync())
+	newest := int64(disk.generation % 2)
+	assert.NoError(t, disk.Close())
+
+	// damage the superblock of the second checkpoint
+	f, err := os.OpenFile(file, os.O_RDWR, 0)
+	assert.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff}, newest*sectorSize+20)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	disk = newTestMappedDisk(t, file)
+	assert.NoError(t, disk.ReadPage(0, buf))
+	assert.Equal(t, byte(1), buf[0])
+	assert.NoError(t, disk.Close())
+}
+
+func Test_BPMOnMappedDiskManager(t *testing.T) {
+	file := testDBFile(t)
+	bpm := NewParallelBufferPool(2, 4, newTestMappedDisk(t, file))
+	for i := 0; i < 32; i++ {
+		p, err := bpm.NewPage()
+		assert.NoError(t, err)
+		p.GetData()[0] = byte(i)
+		assert.True(t, bpm.UnpinPage(p.GetPageID(), true))
+	}
+	assert.NoError(t, bpm.Close())
+	info, err := os.Stat(file)
+	assert.NoError(t, err)
+	// sparse pages take a fraction of their size
+	assert.Less(t, info.Size(), int64(32*DefaultPageSize/4))
+
+	bpm = NewParallelBufferPool(2, 4, newTestMappedDisk(t, file))
+	for i := 0; i < 32; i++ {
+		p, err := bpm.FetchPage(i)
+		assert.NoError(t, err)
+		assert.Equal(t, byte(i), p.GetData()[0])
+		assert.True(t, bpm.UnpinPage(i, false))
+	}
+	assert.NoError(t, bpm.Close())
+}
+
+func Test_MappedDiskManagerPageSize(t *testing.T) {
+	file := testDBFile(t)
+	codec, err := NewFlateCodec(flate.BestSpeed)
+	assert.NoError(t, err)
+	disk, err := NewMappedDiskManager(file, codec, WithPageSize(32<<10))
+	assert.NoError(t, err)
+	page := make([]byte, 32<<10)
+	copy(page, "large page")
+	assert.NoError(t, disk.WritePage(0, page))
+	assert.NoError(t, disk.Sync())
+	assert.NoError(t, disk.Close())
+
+	_, err = NewMappedDiskManager(file, codec, WithPageSize(DefaultPageSize))
+	assert.ErrorIs(t, err, ErrPageSizeMismatch)
+	disk = newTestMappedDisk(t, file)
+	assert.Equal(t, 32<<10, disk.PageSize())
+	read := make([]byte, 32<<10)
+	assert.NoError(t, disk.ReadPage(0, read))
+	assert.Equal(t, page, read)
+	assert.NoError(t, disk.Close())
+}
@@ -0,0 +1,90 @@
+package buff
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// MemDiskManager keeps pages in memory, it is meant for tests and for trees
+// that do not need to outlive the process. Close does not discard the content,
+// so a closed MemDiskManager can back a new buffer pool to simulate a reopen
+type MemDiskManager struct {
+	mu       *sync.Mutex
+	pageSize int
+	pages    map[int64][]byte
+	alloc    *allocMap
+}
+
+// NewMemDiskManager only uses WithPageSize
+func NewMemDiskManager(opts ...DiskOption) (*MemDiskManager, error) {
+	pageSize, err := newDiskConfig(opts).pageSizeOrDefault()
+	if err != nil {
+		return nil, err
+	}
+	return &MemDiskManager{
+		mu:       &sync.Mutex{},
+		pageSize: pageSize,
+		pages:    map[int64][]byte{},
+		alloc:    newAllocMap(pageSize, nil),
+	}, nil
+}
+
+func (d *MemDiskManager) PageSize() int {
+	return d.pageSize
+}
+
+func (d *MemDiskManager) ReadPage(pageID int64, data []byte) error {
+	if len(data) != d.pageSize {
+		return fmt.Errorf("buffer provided must have size %d", d.pageSize)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	page, ok := d.pages[pageID]
+	if !ok {
+		return io.EOF
+	}
+	copy(data, page)
+	return nil
+}
+
+func (d *MemDiskManager) WritePage(pageID int64, data []byte) error {
+	if len(data) != d.pageSize {
+		return fmt.Errorf("buffer provided must have size %d", d.pageSize)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	page, ok := d.pages[pageID]
+	if !ok {
+		page = make([]byte, d.pageSize)
+		d.pages[pageID] = page
+	}
+	copy(page, data)
+	return nil
+}
+
+func (d *MemDiskManager) AllocatePage(numShards, shard int) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.alloc.allocate(numShards, shard)
+}
+
+func (d *MemDiskManager) DeallocatePage(pageID int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.alloc.deallocate(pageID)
+}
+
+func (d *MemDiskManager) IsAllocated(pageID int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.alloc.isAllocated(pageID)
+}
+
+func (d *MemDiskManager) Sync() error {
+	return nil
+}
+
+func (d *MemDiskManager) Close() error {
+	return nil
+}
@@ -0,0 +1,59 @@
+package buff
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_MemDiskManager(t *testing.T) {
+	disk := newMemDisk(t)
+	buf := make([]byte, DefaultPageSize)
+	assert.ErrorIs(t, disk.ReadPage(0, buf), io.EOF)
+
+	// shard 1 of 2 only gets odd page ids
+	for _, expect := range []int{1, 3, 5} {
+		pageID, err := disk.AllocatePage(2, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, expect, pageID)
+	}
+	assert.NoError(t, disk.DeallocatePage(3))
+	assert.False(t, disk.IsAllocated(3))
+	assert.Error(t, disk.DeallocatePage(3))
+	pageID, err := disk.AllocatePage(2, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, pageID)
+
+	// the page is copied, later changes to the caller's buffer are not stored
+	buf[0] = 1
+	assert.NoError(t, disk.WritePage(3, buf))
+	buf[0] = 2
+	read := make([]byte, DefaultPageSize)
+	assert.NoError(t, disk.ReadPage(3, read))
+	assert.Equal(t, byte(1), read[0])
+	assert.Error(t, disk.WritePage(3, buf[:10]))
+}
+
+func Test_BPMOnMemDiskManager(t *testing.T) {
+	disk := newMemDisk(t)
+	poolSize := 2
+	bpm := NewBufferPool(poolSize, disk)
+	for i := 0; i < 5; i++ {
+		p, err := bpm.NewPage()
+		assert.NoError(t, err)
+		p.GetData()[0] = byte(i + 1)
+		assert.True(t, bpm.UnpinPage(p.GetPageID(), true))
+	}
+	assert.NoError(t, bpm.Close())
+
+	// content outlives Close, a new pool sees every page
+	bpm = NewBufferPool(poolSize, disk)
+	for i := 0; i < 5; i++ {
+		p, err := bpm.FetchPage(i)
+		assert.NoError(t, err)
+		assert.Equal(t, byte(i+1), p.GetData()[0])
+		assert.True(t, bpm.UnpinPage(i, false))
+	}
+	assert.NoError(t, bpm.Close())
+}
@@ -0,0 +1,95 @@
+//go:build !windows
+// +build !windows
+
+package buff
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// WithMmapReads makes FileDiskManager serve page reads from a shared read-only mapping of the
+// file instead of pread. Writes still go through the file, the kernel keeps the mapping coherent with them
+func WithMmapReads() DiskOption {
+	return func(c *diskConfig) {
+		c.mmapReads = true
+	}
+}
+
+func newMmapReader(f *os.File) *mmapReader {
+	return &mmapReader{mu: &sync.RWMutex{}, f: f}
+}
+
+// mmapReader maps the whole file and remaps it when a read goes past the mapped length
+type mmapReader struct {
+	mu   *sync.RWMutex
+	f    *os.File
+	data []byte
+}
+
+func (r *mmapReader) readAt(offset int64, data []byte) error {
+	r.mu.RLock()
+	size := int64(len(data))
+	if offset+size <= int64(len(r.data)) {
+		copy(data, r.data[offset:offset+size])
+		r.mu.RUnlock()
+		return nil
+	}
+	r.mu.RUnlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.lockedRemap(); err != nil {
+		return err
+	}
+	if offset >= int64(len(r.data)) {
+		return io.EOF
+	}
+	if offset+size > int64(len(r.data)) {
+		return fmt.Errorf("only %d bytes mapped at offset %d, expect %d: %w",
+			int64(len(r.data))-offset, offset, size, io.ErrUnexpectedEOF)
+	}
+	copy(data, r.data[offset:offset+size])
+	return nil
+}
+
+// lockedRemap maps the file again if it grew since the last mapping
+func (r *mmapReader) lockedRemap() error {
+	info, err := r.f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	if size <= int64(len(r.data)) {
+		return nil
+	}
+	if err := r.lockedUnmap(); err != nil {
+		return err
+	}
+	data, err := syscall.Mmap(int(r.f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("failed to mmap %d bytes of %s: %w", size, r.f.Name(), err)
+	}
+	r.data = data
+	return nil
+}
+
+func (r *mmapReader) lockedUnmap() error {
+	if r.data == nil {
+		return nil
+	}
+	if err := syscall.Munmap(r.data); err != nil {
+		return err
+	}
+	r.data = nil
+	return nil
+}
+
+func (r *mmapReader) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lockedUnmap()
+}
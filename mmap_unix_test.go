@@ -0,0 +1,43 @@
+//go:build !windows
+// +build !windows
+
+package buff
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_DiskManagerMmapReads(t *testing.T) {
+	file := testDBFile(t)
+	disk, err := NewDiskManager(file, WithMmapReads())
+	assert.NoError(t, err)
+	buf := make([]byte, DefaultPageSize)
+	assert.ErrorIs(t, disk.ReadPage(0, buf), io.EOF)
+
+	// writes after the file has been mapped are visible, growing the file remaps it
+	for i := 0; i < 3; i++ {
+		pageID, err := disk.AllocatePage(1, 0)
+		assert.NoError(t, err)
+		buf[0] = byte(i + 1)
+		assert.NoError(t, disk.WritePage(int64(pageID), buf))
+		read := make([]byte, DefaultPageSize)
+		assert.NoError(t, disk.ReadPage(int64(pageID), read))
+		assert.Equal(t, buf, read)
+	}
+	buf[0] = 9
+	assert.NoError(t, disk.WritePage(1, buf))
+	assert.NoError(t, disk.ReadPage(1, buf))
+	assert.Equal(t, byte(9), buf[0])
+	assert.NoError(t, disk.Close())
+
+	disk, err = NewDiskManager(file, WithMmapReads())
+	assert.NoError(t, err)
+	for i, expect := range []byte{1, 9, 3} {
+		assert.NoError(t, disk.ReadPage(int64(i), buf))
+		assert.Equal(t, expect, buf[0])
+	}
+	assert.NoError(t, disk.Close())
+}
@@ -0,0 +1,25 @@
+//go:build windows
+// +build windows
+
+package buff
+
+import "os"
+
+// WithMmapReads is a no-op on windows, pages are read with ReadAt
+func WithMmapReads() DiskOption {
+	return func(c *diskConfig) {}
+}
+
+func newMmapReader(f *os.File) *mmapReader {
+	return nil
+}
+
+type mmapReader struct{}
+
+func (r *mmapReader) readAt(offset int64, data []byte) error {
+	panic("unreachable")
+}
+
+func (r *mmapReader) close() error {
+	return nil
+}
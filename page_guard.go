@@ -0,0 +1,83 @@
+package buff
+
+// ReadPageGuard holds a pin and the read latch of a page,
+// both are released by Drop which is safe to call more than once
+type ReadPageGuard struct {
+	bpm  *BufferPool
+	page *Page
+}
+
+// WritePageGuard holds a pin and the write latch of a page, the page
+// is marked dirty when the guard is dropped
+type WritePageGuard struct {
+	bpm  *BufferPool
+	page *Page
+}
+
+// FetchPageRead fetches pageID and takes its read latch
+func (b *BufferPool) FetchPageRead(pageID int) (*ReadPageGuard, error) {
+	page, err := b.FetchPage(pageID)
+	if err != nil {
+		return nil, err
+	}
+	page.mu.RLock()
+	return &ReadPageGuard{bpm: b, page: page}, nil
+}
+
+// FetchPageWrite fetches pageID and takes its write latch
+func (b *BufferPool) FetchPageWrite(pageID int) (*WritePageGuard, error) {
+	page, err := b.FetchPage(pageID)
+	if err != nil {
+		return nil, err
+	}
+	page.mu.Lock()
+	return &WritePageGuard{bpm: b, page: page}, nil
+}
+
+// NewPageWrite creates a new page and returns it write latched
+func (b *BufferPool) NewPageWrite() (*WritePageGuard, error) {
+	page, err := b.NewPage()
+	if err != nil {
+		return nil, err
+	}
+	page.mu.Lock()
+	return &WritePageGuard{bpm: b, page: page}, nil
+}
+
+func (g *ReadPageGuard) GetPageID() int {
+	return g.page.GetPageID()
+}
+
+func (g *ReadPageGuard) GetData() []byte {
+	return g.page.GetData()
+}
+
+// Drop releases the latch then the pin
+func (g *ReadPageGuard) Drop() {
+	if g.page == nil {
+		return
+	}
+	page := g.page
+	g.page = nil
+	page.mu.RUnlock()
+	g.bpm.UnpinPage(page.GetPageID(), false)
+}
+
+func (g *WritePageGuard) GetPageID() int {
+	return g.page.GetPageID()
+}
+
+func (g *WritePageGuard) GetData() []byte {
+	return g.page.GetData()
+}
+
+// Drop releases the latch then unpins the page as dirty
+func (g *WritePageGuard) Drop() {
+	if g.page == nil {
+		return
+	}
+	page := g.page
+	g.page = nil
+	page.mu.Unlock()
+	g.bpm.UnpinPage(page.GetPageID(), true)
+}
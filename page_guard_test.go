@@ -0,0 +1,91 @@
+package buff
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_PageGuardReleasesPinAndLatch(t *testing.T) {
+	disk, err := NewDiskManager(testDBFile(t))
+	assert.NoError(t, err)
+	bpm := NewBufferPool(2, disk)
+
+	wg, err := bpm.NewPageWrite()
+	assert.NoError(t, err)
+	pageID := wg.GetPageID()
+	copy(wg.GetData(), []byte("guarded"))
+	wg.Drop()
+	// second drop is a no-op
+	wg.Drop()
+
+	page := bpm.pageTable[pageID]
+	assert.Equal(t, 0, page.pinCount)
+	assert.True(t, page.dirty)
+
+	r1, err := bpm.FetchPageRead(pageID)
+	assert.NoError(t, err)
+	r2, err := bpm.FetchPageRead(pageID)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("guarded"), r1.GetData()[:7])
+	assert.Equal(t, 2, page.pinCount)
+
+	// writer must wait for both readers
+	acquired := make(chan struct{})
+	go func() {
+		w, err := bpm.FetchPageWrite(pageID)
+		assert.NoError(t, err)
+		// drop before signalling, Close must not see the pin of w
+		w.Drop()
+		close(acquired)
+	}()
+	r1.Drop()
+	select {
+	case <-acquired:
+		t.Fatal("write latch acquired while a read guard is held")
+	case <-time.After(20 * time.Millisecond):
+	}
+	r2.Drop()
+	<-acquired
+	assert.NoError(t, bpm.Close())
+}
+
+func Test_PageGuardConcurrentWriters(t *testing.T) {
+	disk, err := NewDiskManager(testDBFile(t))
+	assert.NoError(t, err)
+	bpm := NewBufferPool(4, disk)
+
+	w, err := bpm.NewPageWrite()
+	assert.NoError(t, err)
+	pageID := w.GetPageID()
+	w.Drop()
+
+	var (
+		wg      sync.WaitGroup
+		workers = 10
+		rounds  = 100
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				guard, err := bpm.FetchPageWrite(pageID)
+				if !assert.NoError(t, err) {
+					return
+				}
+				guard.GetData()[0]++
+				guard.Drop()
+			}
+		}()
+	}
+	wg.Wait()
+
+	r, err := bpm.FetchPageRead(pageID)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(workers*rounds%256), r.GetData()[0])
+	r.Drop()
+	assert.NoError(t, bpm.Close())
+}
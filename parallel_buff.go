@@ -0,0 +1,190 @@
+package buff
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// ParallelBufferPool shards pages across multiple BufferPool instances by
+// pageID % numInstances, each instance has its own latch and replacer
+type ParallelBufferPool struct {
+	instances   []*BufferPool
+	diskManager DiskManager
+	// instance which the next NewPage call starts from
+	startIndex uint64
+}
+
+// NewParallelBufferPool creates numInstances instances of poolSize frames each, every instance
+// needs a replacer of its own, so a replacer can only be chosen WithReplacerFunc
+func NewParallelBufferPool(numInstances, poolSize int, d DiskManager, opts ...Option) *ParallelBufferPool {
+	if numInstances < 1 {
+		panic("parallel buffer pool requires at least 1 instance")
+	}
+	if numInstances > 1 {
+		// options only record the replacer factory, the probe does not create anything
+		probe := &BufferPool{newReplacer: newDefaultReplacer}
+		for _, opt := range opts {
+			opt(probe)
+		}
+		if probe.newReplacer == nil {
+			panic("instances of a parallel buffer pool cannot share a replacer, use WithReplacerFunc")
+		}
+	}
+	instances := make([]*BufferPool, numInstances)
+	for idx := range instances {
+		instances[idx] = newBufferPoolInstance(poolSize, numInstances, idx, d, opts...)
+	}
+	return &ParallelBufferPool{
+		instances:   instances,
+		diskManager: d,
+	}
+}
+
+// instanceOf returns the instance owning pageID, nil if pageID is negative
+func (p *ParallelBufferPool) instanceOf(pageID int) *BufferPool {
+	if pageID < 0 {
+		return nil
+	}
+	return p.instances[pageID%len(p.instances)]
+}
+
+func errInvalidPageID(pageID int) error {
+	return fmt.Errorf("invalid page id %d", pageID)
+}
+
+// Size returns total number of frames of all instances
+func (p *ParallelBufferPool) Size() int {
+	total := 0
+	for _, ins := range p.instances {
+		total += ins.Size()
+	}
+	return total
+}
+
+func (p *ParallelBufferPool) PageSize() int {
+	return p.instances[0].PageSize()
+}
+
+func (p *ParallelBufferPool) PageDataSize() int {
+	return p.instances[0].PageDataSize()
+}
+
+// NewPage asks each instance in round robin order, starting from a different
+// instance every call, return ErrBufferFull if all of them are full
+func (p *ParallelBufferPool) NewPage() (*Page, error) {
+	n := len(p.instances)
+	start := int((atomic.AddUint64(&p.startIndex, 1) - 1) % uint64(n))
+	for i := 0; i < n; i++ {
+		ins := p.instances[(start+i)%n]
+		page, err := ins.NewPage()
+		if err == nil {
+			return page, nil
+		}
+		if !errors.Is(err, ErrBufferFull) {
+			return nil, err
+		}
+	}
+	return nil, ErrBufferFull
+}
+
+func (p *ParallelBufferPool) FetchPage(pageID int) (*Page, error) {
+	ins := p.instanceOf(pageID)
+	if ins == nil {
+		return nil, errInvalidPageID(pageID)
+	}
+	return ins.FetchPage(pageID)
+}
+
+func (p *ParallelBufferPool) UnpinPage(pageID int, isDirty bool) bool {
+	ins := p.instanceOf(pageID)
+	if ins == nil {
+		return false
+	}
+	return ins.UnpinPage(pageID, isDirty)
+}
+
+func (p *ParallelBufferPool) DeletePage(pageID int) bool {
+	ins := p.instanceOf(pageID)
+	if ins == nil {
+		return false
+	}
+	return ins.DeletePage(pageID)
+}
+
+func (p *ParallelBufferPool) FlushPage(pageID int) error {
+	ins := p.instanceOf(pageID)
+	if ins == nil {
+		return errInvalidPageID(pageID)
+	}
+	return ins.FlushPage(pageID)
+}
+
+func (p *ParallelBufferPool) FlushAllPages() error {
+	for _, ins := range p.instances {
+		if err := ins.FlushAllPages(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *ParallelBufferPool) Sync() error {
+	if err := p.FlushAllPages(); err != nil {
+		return err
+	}
+	return p.diskManager.Sync()
+}
+
+// Close stops background flushers, flushes all instances and closes the shared disk manager once,
+// it refuses to close and returns ErrPagesPinned if any page is still pinned, see BufferPool.Close
+func (p *ParallelBufferPool) Close() error {
+	for _, ins := range p.instances {
+		ins.stopFlusher()
+	}
+	for _, ins := range p.instances {
+		if err := ins.checkNoPinnedPages(); err != nil {
+			return err
+		}
+	}
+	if err := p.FlushAllPages(); err != nil {
+		return err
+	}
+	if err := p.diskManager.Sync(); err != nil {
+		return err
+	}
+	return p.diskManager.Close()
+}
+
+func (p *ParallelBufferPool) FetchPageRead(pageID int) (*ReadPageGuard, error) {
+	ins := p.instanceOf(pageID)
+	if ins == nil {
+		return nil, errInvalidPageID(pageID)
+	}
+	return ins.FetchPageRead(pageID)
+}
+
+func (p *ParallelBufferPool) FetchPageWrite(pageID int) (*WritePageGuard, error) {
+	ins := p.instanceOf(pageID)
+	if ins == nil {
+		return nil, errInvalidPageID(pageID)
+	}
+	return ins.FetchPageWrite(pageID)
+}
+
+func (p *ParallelBufferPool) NewPageWrite() (*WritePageGuard, error) {
+	page, err := p.NewPage()
+	if err != nil {
+		return nil, err
+	}
+	page.mu.Lock()
+	return &WritePageGuard{bpm: p.instanceOf(page.GetPageID()), page: page}, nil
+}
+
+func (p *ParallelBufferPool) Prefetch(pageID int) error {
+	ins := p.instanceOf(pageID)
+	if ins == nil {
+		return errInvalidPageID(pageID)
+	}
+	return ins.Prefetch(pageID)
+}
@@ -0,0 +1,107 @@
+package buff
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParallelBPMShardsPages(t *testing.T) {
+	disk, err := NewDiskManager(testDBFile(t))
+	assert.NoError(t, err)
+	numInstances, poolSize := 3, 2
+	bpm := NewParallelBufferPool(numInstances, poolSize, disk)
+	assert.Equal(t, numInstances*poolSize, bpm.Size())
+
+	// round robin hands out sequential page ids
+	for i := 0; i < numInstances*poolSize; i++ {
+		page, err := bpm.NewPage()
+		assert.NoError(t, err)
+		assert.Equal(t, i, page.GetPageID())
+		assert.Same(t, page, bpm.instances[i%numInstances].pageTable[i])
+		copy(page.GetData(), []byte{byte(i)})
+	}
+	_, err = bpm.NewPage()
+	assert.ErrorIs(t, err, ErrBufferFull)
+
+	// only instance 1 has free frame, NewPage must still find it
+	assert.True(t, bpm.UnpinPage(4, true))
+	page, err := bpm.NewPage()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, page.GetPageID()%numInstances)
+	assert.True(t, bpm.UnpinPage(page.GetPageID(), false))
+
+	page4, err := bpm.FetchPage(4)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(4), page4.GetData()[0])
+	assert.True(t, bpm.UnpinPage(4, false))
+
+	// negative page ids belong to no instance
+	_, err = bpm.FetchPage(-1)
+	assert.Error(t, err)
+	assert.False(t, bpm.UnpinPage(-1, false))
+	assert.False(t, bpm.DeletePage(-4))
+	assert.Error(t, bpm.FlushPage(-2))
+	_, err = bpm.FetchPageRead(-1)
+	assert.Error(t, err)
+	_, err = bpm.FetchPageWrite(-1)
+	assert.Error(t, err)
+	assert.Error(t, bpm.Prefetch(-1))
+}
+
+func Test_ParallelBPMRejectsSharedReplacer(t *testing.T) {
+	assert.Panics(t, func() {
+		NewParallelBufferPool(2, 2, newMemDisk(t), WithReplacer(NewLRUReplacer(2)))
+	})
+	bpm := NewParallelBufferPool(1, 2, newMemDisk(t), WithReplacer(NewLRUReplacer(2)))
+	assert.NoError(t, bpm.Close())
+	bpm = NewParallelBufferPool(2, 2, newMemDisk(t), WithReplacerFunc(func(size int) Replacer {
+		return NewClockReplacer(size)
+	}))
+	assert.NoError(t, bpm.Close())
+	// the factory is only called with the size of an instance
+	bpm = NewParallelBufferPool(2, 2, newMemDisk(t), WithReplacerFunc(func(size int) Replacer {
+		return NewLRUReplacer(size)
+	}))
+	p, err := bpm.NewPage()
+	assert.NoError(t, err)
+	assert.True(t, bpm.UnpinPage(p.GetPageID(), false))
+	assert.NoError(t, bpm.Close())
+}
+
+func Test_ParallelBPMConcurrent(t *testing.T) {
+	disk, err := NewDiskManager(testDBFile(t))
+	assert.NoError(t, err)
+	bpm := NewParallelBufferPool(4, 5, disk, WithReplacerFunc(func(size int) Replacer {
+		return NewClockReplacer(size)
+	}))
+	var (
+		wg      sync.WaitGroup
+		workers = 8
+		rounds  = 50
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				page, err := bpm.NewPage()
+				if err != nil {
+					continue
+				}
+				pageID := page.GetPageID()
+				page.GetData()[0] = byte(pageID)
+				assert.True(t, bpm.UnpinPage(pageID, true))
+
+				fetched, err := bpm.FetchPage(pageID)
+				if err != nil {
+					continue
+				}
+				assert.Equal(t, byte(pageID), fetched.GetData()[0])
+				assert.True(t, bpm.UnpinPage(pageID, true))
+			}
+		}()
+	}
+	wg.Wait()
+}
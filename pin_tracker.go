@@ -0,0 +1,150 @@
+package buff
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// maximum number of caller frames recorded for every pin
+const pinStackDepth = 16
+
+// WithPinTracking records the caller stack of every FetchPage/NewPage, so that
+// pages that are never unpinned can be reported together with where they were pinned
+func WithPinTracking() Option {
+	return func(b *BufferPool) {
+		b.pinStacks = map[int][]string{}
+	}
+}
+
+// PinLeak is a page that is still pinned, Stacks holds one entry per outstanding
+// pin when pin tracking is enabled
+type PinLeak struct {
+	PageID   int
+	PinCount int
+	Stacks   []string
+}
+
+func (l PinLeak) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "page %d pinned %d time(s)", l.PageID, l.PinCount)
+	for idx, stack := range l.Stacks {
+		fmt.Fprintf(&sb, "\npin #%d at:\n%s", idx+1, stack)
+	}
+	return sb.String()
+}
+
+// TestingT is the subset of testing.TB used by AssertNoPinnedPages
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+}
+
+// PinLeaks lists every page that is currently pinned ordered by page id
+func (b *BufferPool) PinLeaks() []PinLeak {
+	var leaks []PinLeak
+	locked(b.mu, func() {
+		for pageID, page := range b.pageTable {
+			if page.pinCount == 0 {
+				continue
+			}
+			stacks := append([]string(nil), b.pinStacks[pageID]...)
+			leaks = append(leaks, PinLeak{
+				PageID:   pageID,
+				PinCount: page.pinCount,
+				Stacks:   stacks,
+			})
+		}
+	})
+	sort.Slice(leaks, func(i, j int) bool { return leaks[i].PageID < leaks[j].PageID })
+	return leaks
+}
+
+// AssertNoPinnedPages fails t with the call sites of every outstanding pin
+func (b *BufferPool) AssertNoPinnedPages(t TestingT) {
+	t.Helper()
+	if leaks := b.PinLeaks(); len(leaks) > 0 {
+		t.Errorf("%s", formatPinLeaks(leaks))
+	}
+}
+
+func formatPinLeaks(leaks []PinLeak) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d page(s) still pinned", len(leaks))
+	for _, l := range leaks {
+		sb.WriteString("\n")
+		sb.WriteString(l.String())
+	}
+	return sb.String()
+}
+
+func (b *BufferPool) lockedRecordPin(pageID int) {
+	if b.pinStacks == nil {
+		return
+	}
+	b.pinStacks[pageID] = append(b.pinStacks[pageID], callerStack())
+}
+
+// lockedRecordUnpin forgets the latest pin of pageID, unpin does not tell
+// which holder is releasing the page
+func (b *BufferPool) lockedRecordUnpin(pageID int) {
+	if b.pinStacks == nil {
+		return
+	}
+	stacks := b.pinStacks[pageID]
+	if len(stacks) <= 1 {
+		delete(b.pinStacks, pageID)
+		return
+	}
+	b.pinStacks[pageID] = stacks[:len(stacks)-1]
+}
+
+// directory of this package, frames from its non test files are not part of pin call sites
+var packageDir = func() string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Dir(file)
+}()
+
+func isBufferPoolFrame(frame runtime.Frame) bool {
+	return filepath.Dir(frame.File) == packageDir && !strings.HasSuffix(frame.File, "_test.go")
+}
+
+// callerStack formats the stack starting from the first caller outside of the buffer pool
+func callerStack() string {
+	pcs := make([]uintptr, pinStackDepth+8)
+	n := runtime.Callers(2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	var (
+		sb      strings.Builder
+		written int
+		more    = true
+		frame   runtime.Frame
+	)
+	for more && written < pinStackDepth {
+		frame, more = frames.Next()
+		if written == 0 && isBufferPoolFrame(frame) {
+			continue
+		}
+		fmt.Fprintf(&sb, "\t%s\n\t\t%s:%d\n", frame.Function, frame.File, frame.Line)
+		written++
+	}
+	return sb.String()
+}
+
+func (p *ParallelBufferPool) PinLeaks() []PinLeak {
+	var leaks []PinLeak
+	for _, ins := range p.instances {
+		leaks = append(leaks, ins.PinLeaks()...)
+	}
+	sort.Slice(leaks, func(i, j int) bool { return leaks[i].PageID < leaks[j].PageID })
+	return leaks
+}
+
+func (p *ParallelBufferPool) AssertNoPinnedPages(t TestingT) {
+	t.Helper()
+	if leaks := p.PinLeaks(); len(leaks) > 0 {
+		t.Errorf("%s", formatPinLeaks(leaks))
+	}
+}
@@ -0,0 +1,63 @@
+package buff
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingT struct {
+	errors []string
+}
+
+func (r *recordingT) Helper() {}
+func (r *recordingT) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func leakOnePin(bpm *BufferPool, pageID int) {
+	_, _ = bpm.FetchPage(pageID)
+}
+
+func Test_PinTrackingReportsLeaks(t *testing.T) {
+	disk, err := NewDiskManager(testDBFile(t))
+	assert.NoError(t, err)
+	bpm := NewBufferPool(3, disk, WithPinTracking())
+
+	for i := 0; i < 2; i++ {
+		_, err := bpm.NewPage()
+		assert.NoError(t, err)
+		assert.True(t, bpm.UnpinPage(i, true))
+	}
+	bpm.AssertNoPinnedPages(t)
+
+	leakOnePin(bpm, 1)
+	leakOnePin(bpm, 1)
+	guard, err := bpm.FetchPageRead(0)
+	assert.NoError(t, err)
+	guard.Drop()
+
+	leaks := bpm.PinLeaks()
+	assert.Len(t, leaks, 1)
+	assert.Equal(t, 1, leaks[0].PageID)
+	assert.Equal(t, 2, leaks[0].PinCount)
+	assert.Len(t, leaks[0].Stacks, 2)
+	// call site outside of the buffer pool is recorded
+	assert.Contains(t, leaks[0].Stacks[0], "buff.leakOnePin")
+	assert.NotContains(t, leaks[0].Stacks[0], "(*BufferPool).FetchPage")
+
+	rec := &recordingT{}
+	bpm.AssertNoPinnedPages(rec)
+	assert.Len(t, rec.errors, 1)
+	assert.Contains(t, rec.errors[0], "page 1 pinned 2 time(s)")
+
+	err = bpm.Close()
+	assert.ErrorIs(t, err, ErrPagesPinned)
+	assert.Contains(t, err.Error(), "pin_tracker_test.go")
+
+	assert.True(t, bpm.UnpinPage(1, false))
+	assert.True(t, bpm.UnpinPage(1, false))
+	bpm.AssertNoPinnedPages(t)
+	assert.NoError(t, bpm.Close())
+}
@@ -1,6 +1,8 @@
 package buff
 
 import (
+	"sync"
+
 	lru "github.com/hashicorp/golang-lru"
 )
 
@@ -17,14 +19,15 @@ type Replacer interface {
 
 	// items that can be victimized
 	Size() int
+
+	// frameID has just been accessed (fetched or newly created)
+	RecordAccess(frameID int)
 }
 
 type LRUReplacer struct {
 	internal *lru.Cache
 }
 
-type ClockReplacer struct{}
-
 // TODO
 func NewLRUReplacer(numPage int) *LRUReplacer {
 	c, err := lru.New(numPage)
@@ -51,3 +54,75 @@ func (r *LRUReplacer) Unpin(frameID int) {
 	r.internal.ContainsOrAdd(frameID, 1)
 }
 func (r *LRUReplacer) Size() int { return r.internal.Len() }
+
+// RecordAccess is a no-op, recency is only tracked on Unpin
+func (r *LRUReplacer) RecordAccess(frameID int) {}
+
+// ClockReplacer approximates LRU with a second-chance sweep over frames
+type ClockReplacer struct {
+	mu       *sync.Mutex
+	hand     int
+	size     int
+	inClock  []bool
+	refFlags []bool
+}
+
+func NewClockReplacer(numPage int) *ClockReplacer {
+	return &ClockReplacer{
+		mu:       &sync.Mutex{},
+		inClock:  make([]bool, numPage),
+		refFlags: make([]bool, numPage),
+	}
+}
+
+func (r *ClockReplacer) Victim() (int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size == 0 {
+		return 0, false
+	}
+	// at most two rounds: first round may only clear reference flags
+	for {
+		frameID := r.hand
+		r.hand = (r.hand + 1) % len(r.inClock)
+		if !r.inClock[frameID] {
+			continue
+		}
+		if r.refFlags[frameID] {
+			r.refFlags[frameID] = false
+			continue
+		}
+		r.inClock[frameID] = false
+		r.size--
+		return frameID, true
+	}
+}
+
+func (r *ClockReplacer) Pin(frameID int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.inClock[frameID] {
+		r.inClock[frameID] = false
+		r.refFlags[frameID] = false
+		r.size--
+	}
+}
+
+func (r *ClockReplacer) Unpin(frameID int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.inClock[frameID] {
+		r.inClock[frameID] = true
+		r.size++
+	}
+	r.refFlags[frameID] = true
+}
+
+// RecordAccess is a no-op, reference flag is set on Unpin
+func (r *ClockReplacer) RecordAccess(frameID int) {}
+
+func (r *ClockReplacer) Size() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.size
+}
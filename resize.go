@@ -0,0 +1,107 @@
+package buff
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+)
+
+// Resize changes the number of frames of the pool. Growing adds free frames. Shrinking
+// evicts unpinned pages, writing back the dirty ones without holding the pool latch, and
+// fails with ErrPagesPinned if more than size pages are pinned, a failed write back
+// also fails it but the pool keeps its size. Pinned pages stay valid for their
+// holders, but their frames may be renumbered.
+// The replacer is recreated for the new size, see WithReplacerFunc
+func (b *BufferPool) Resize(size int) error {
+	if size < 1 {
+		return fmt.Errorf("pool size must be at least 1, got %d", size)
+	}
+	for {
+		dirty, err := b.resize(size)
+		if err != nil || dirty == invalidPageID {
+			return err
+		}
+		if err := b.writeBackVictim(dirty); err != nil {
+			return fmt.Errorf("cannot shrink to %d frames: %w", size, err)
+		}
+	}
+}
+
+// resize does the work of Resize under the pool latch, it stops at the first dirty
+// victim and returns its page id, Resize writes it back and calls resize again
+func (b *BufferPool) resize(size int) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.newReplacer == nil {
+		return invalidPageID, errors.New("cannot resize a pool whose replacer was given by WithReplacer")
+	}
+	if size >= len(b.pages) {
+		for frameID := len(b.pages); frameID < size; frameID++ {
+			b.pages = append(b.pages, newFrame(frameID))
+			b.freeList.PushFront(frameID)
+		}
+		b.lockedRebuildReplacer(size, nil)
+		b.size = size
+		return invalidPageID, nil
+	}
+
+	pinned := 0
+	for _, page := range b.pageTable {
+		if page.pinCount > 0 {
+			pinned++
+		}
+	}
+	if pinned > size {
+		return invalidPageID, fmt.Errorf("cannot shrink to %d frames: %d %w", size, pinned, ErrPagesPinned)
+	}
+	for len(b.pageTable) > size {
+		page, dirty, err := b.lockedEvict()
+		if err != nil {
+			return invalidPageID, fmt.Errorf("cannot shrink to %d frames: %w", size, err)
+		}
+		if dirty != invalidPageID {
+			return dirty, nil
+		}
+		page.reset()
+		b.freeList.PushFront(page.frameID)
+	}
+
+	// move resident pages to the lowest frames, the rest are free
+	renumbered := make(map[int]int, len(b.pageTable))
+	pages := make([]*Page, 0, size)
+	for _, page := range b.pages {
+		if page.pageID != invalidPageID {
+			renumbered[page.frameID] = len(pages)
+			page.frameID = len(pages)
+			pages = append(pages, page)
+		}
+	}
+	b.freeList = list.New()
+	for frameID := len(pages); frameID < size; frameID++ {
+		pages = append(pages, newFrame(frameID))
+		b.freeList.PushFront(frameID)
+	}
+	b.pages = pages
+	b.lockedRebuildReplacer(size, renumbered)
+	b.size = size
+	return invalidPageID, nil
+}
+
+// lockedRebuildReplacer replaces the replacer with one sized for size frames. Evictable
+// frames are handed over in the order the old replacer would have evicted them, frame ids
+// found in renumbered are translated
+func (b *BufferPool) lockedRebuildReplacer(size int, renumbered map[int]int) {
+	replacer := b.newReplacer(size)
+	for {
+		frameID, ok := b.replacer.Victim()
+		if !ok {
+			break
+		}
+		if newID, ok := renumbered[frameID]; ok {
+			frameID = newID
+		}
+		replacer.RecordAccess(frameID)
+		replacer.Unpin(frameID)
+	}
+	b.replacer = replacer
+}
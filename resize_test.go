@@ -0,0 +1,101 @@
+package buff
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_BPMResize(t *testing.T) {
+	disk := newMemDisk(t)
+	bpm := NewBufferPool(2, disk)
+	for i := 0; i < 2; i++ {
+		p, err := bpm.NewPage()
+		assert.NoError(t, err)
+		p.GetData()[0] = byte(i + 1)
+	}
+	_, err := bpm.NewPage()
+	assert.ErrorIs(t, err, ErrBufferFull)
+
+	// growing adds free frames
+	assert.NoError(t, bpm.Resize(4))
+	assert.Equal(t, 4, bpm.Size())
+	for i := 2; i < 4; i++ {
+		p, err := bpm.NewPage()
+		assert.NoError(t, err)
+		p.GetData()[0] = byte(i + 1)
+	}
+	assert.Equal(t, 0, bpm.Stats().FreeFrames)
+
+	// only page 3 stays pinned, it is moved to a low frame
+	for i := 0; i < 3; i++ {
+		assert.True(t, bpm.UnpinPage(i, true))
+	}
+	assert.NoError(t, bpm.Resize(2))
+	assert.Equal(t, 2, bpm.Size())
+	frames := bpm.Frames()
+	assert.Len(t, frames, 2)
+	assert.Equal(t, uint64(2), bpm.Stats().Evictions)
+	assert.Equal(t, FrameInfo{FrameID: frames[0].FrameID, PageID: 3, PinCount: 1}, frames[0])
+
+	// both pinned, no frame left for anything else
+	assert.True(t, bpm.UnpinPage(3, true))
+	for i := 0; i < 2; i++ {
+		p, err := bpm.FetchPage(i)
+		assert.NoError(t, err)
+		assert.Equal(t, byte(i+1), p.GetData()[0])
+	}
+	assert.ErrorIs(t, bpm.Resize(1), ErrPagesPinned)
+	assert.Equal(t, 2, bpm.Size())
+	assert.NoError(t, bpm.Resize(2))
+
+	assert.True(t, bpm.UnpinPage(0, false))
+	assert.True(t, bpm.UnpinPage(1, false))
+	assert.NoError(t, bpm.Resize(1))
+	for i := 0; i < 4; i++ {
+		p, err := bpm.FetchPage(i)
+		assert.NoError(t, err)
+		assert.Equal(t, byte(i+1), p.GetData()[0])
+		assert.True(t, bpm.UnpinPage(i, false))
+	}
+	assert.Error(t, bpm.Resize(0))
+	assert.NoError(t, bpm.Close())
+}
+
+func Test_BPMResizeKeepsReplacerOrder(t *testing.T) {
+	bpm := NewBufferPool(3, newMemDisk(t), WithReplacerFunc(func(size int) Replacer {
+		return NewLRUKReplacer(size, 2)
+	}))
+	for i := 0; i < 3; i++ {
+		_, err := bpm.NewPage()
+		assert.NoError(t, err)
+	}
+	for _, pageID := range []int{1, 0, 2} {
+		assert.True(t, bpm.UnpinPage(pageID, false))
+	}
+	// pages 0 and 1 have the oldest accesses, that order survives rebuilding the replacer
+	assert.NoError(t, bpm.Resize(5))
+	assert.NoError(t, bpm.Resize(1))
+	frames := bpm.Frames()
+	assert.Equal(t, 2, frames[0].PageID)
+
+	fixed := NewBufferPool(1, newMemDisk(t), WithReplacer(NewLRUReplacer(1)))
+	assert.Error(t, fixed.Resize(2))
+}
+
+func Test_BPMResizeFailsOnWriteBack(t *testing.T) {
+	disk := newFaultDisk(t, 1)
+	bpm := NewBufferPool(2, disk)
+	for i := 0; i < 2; i++ {
+		p, err := bpm.NewPage()
+		assert.NoError(t, err)
+		p.GetData()[0] = byte(i + 1)
+		assert.True(t, bpm.UnpinPage(i, true))
+	}
+	disk.FailWrite(1)
+	assert.ErrorIs(t, bpm.Resize(1), ErrInjectedFault)
+	assert.Equal(t, 2, bpm.Size())
+	assert.NoError(t, bpm.Resize(1))
+	assert.Len(t, bpm.Frames(), 1)
+	assert.NoError(t, bpm.Close())
+}
@@ -0,0 +1,112 @@
+package buff
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrSchedulerShutdown is returned for requests scheduled after Shutdown
+var ErrSchedulerShutdown = errors.New("disk scheduler is shut down")
+
+// DiskRequest is one page read or write, Done receives the result exactly once
+type DiskRequest struct {
+	IsWrite bool
+	PageID  int
+	Data    []byte
+	Done    chan error
+}
+
+// DiskScheduler serves disk requests with a pool of worker goroutines. Requests for
+// the same page always go to the same worker, so they complete in the order they are scheduled
+type DiskScheduler struct {
+	diskManager DiskManager
+	queues      []chan *DiskRequest
+	mu          *sync.RWMutex
+	shutdown    bool
+	wg          *sync.WaitGroup
+}
+
+func NewDiskScheduler(d DiskManager, numWorkers int) *DiskScheduler {
+	if numWorkers < 1 {
+		panic("disk scheduler requires at least 1 worker")
+	}
+	s := &DiskScheduler{
+		diskManager: d,
+		queues:      make([]chan *DiskRequest, numWorkers),
+		mu:          &sync.RWMutex{},
+		wg:          &sync.WaitGroup{},
+	}
+	for idx := range s.queues {
+		s.queues[idx] = make(chan *DiskRequest, 64)
+		s.wg.Add(1)
+		go s.work(s.queues[idx])
+	}
+	return s
+}
+
+func (s *DiskScheduler) work(queue chan *DiskRequest) {
+	defer s.wg.Done()
+	for r := range queue {
+		var err error
+		if r.IsWrite {
+			err = s.diskManager.WritePage(int64(r.PageID), r.Data)
+		} else {
+			err = s.diskManager.ReadPage(int64(r.PageID), r.Data)
+		}
+		r.Done <- err
+	}
+}
+
+// Schedule queues r, Done is created if r does not have one. A request for a negative
+// page id or scheduled after Shutdown fails without reaching the disk manager
+func (s *DiskScheduler) Schedule(r *DiskRequest) <-chan error {
+	if r.Done == nil {
+		r.Done = make(chan error, 1)
+	}
+	if r.PageID < 0 {
+		return r.fail(errInvalidPageID(r.PageID))
+	}
+	s.mu.RLock()
+	if s.shutdown {
+		s.mu.RUnlock()
+		return r.fail(ErrSchedulerShutdown)
+	}
+	s.queues[r.PageID%len(s.queues)] <- r
+	s.mu.RUnlock()
+	return r.Done
+}
+
+// fail sends err to Done without blocking the caller, who only receives once Schedule returns
+func (r *DiskRequest) fail(err error) <-chan error {
+	select {
+	case r.Done <- err:
+	default:
+		go func() {
+			r.Done <- err
+		}()
+	}
+	return r.Done
+}
+
+func (s *DiskScheduler) ScheduleRead(pageID int, data []byte) <-chan error {
+	return s.Schedule(&DiskRequest{PageID: pageID, Data: data})
+}
+
+func (s *DiskScheduler) ScheduleWrite(pageID int, data []byte) <-chan error {
+	return s.Schedule(&DiskRequest{IsWrite: true, PageID: pageID, Data: data})
+}
+
+// Shutdown waits for queued requests to complete and stops the workers
+func (s *DiskScheduler) Shutdown() {
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		return
+	}
+	s.shutdown = true
+	for _, queue := range s.queues {
+		close(queue)
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
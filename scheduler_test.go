@@ -0,0 +1,127 @@
+package buff
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_DiskSchedulerKeepsOrderPerPage(t *testing.T) {
+	disk, err := NewDiskManager(testDBFile(t))
+	assert.NoError(t, err)
+	s := NewDiskScheduler(disk, 4)
+
+	var futures []<-chan error
+	for pageID := 0; pageID < 8; pageID++ {
+		for round := 0; round < 10; round++ {
+			data := make([]byte, DefaultPageSize)
+			data[0], data[1] = byte(pageID), byte(round)
+			futures = append(futures, s.ScheduleWrite(pageID, data))
+		}
+	}
+	for _, f := range futures {
+		assert.NoError(t, <-f)
+	}
+	for pageID := 0; pageID < 8; pageID++ {
+		data := make([]byte, DefaultPageSize)
+		assert.NoError(t, <-s.ScheduleRead(pageID, data))
+		assert.Equal(t, []byte{byte(pageID), 9}, data[:2])
+	}
+	assert.ErrorIs(t, <-s.ScheduleRead(100, make([]byte, DefaultPageSize)), io.EOF)
+	assert.Error(t, <-s.ScheduleRead(-1, make([]byte, DefaultPageSize)))
+
+	s.Shutdown()
+	s.Shutdown()
+	assert.ErrorIs(t, <-s.ScheduleRead(0, make([]byte, DefaultPageSize)), ErrSchedulerShutdown)
+	// an unbuffered Done does not block Schedule
+	done := s.Schedule(&DiskRequest{PageID: 0, Data: make([]byte, DefaultPageSize), Done: make(chan error)})
+	assert.ErrorIs(t, <-done, ErrSchedulerShutdown)
+	assert.NoError(t, disk.Close())
+}
+
+func Test_BPMPrefetchThroughScheduler(t *testing.T) {
+	file := testDBFile(t)
+	disk, err := NewDiskManager(file)
+	assert.NoError(t, err)
+	bpm := NewBufferPool(4, disk)
+	for i := 0; i < 4; i++ {
+		p, err := bpm.NewPage()
+		assert.NoError(t, err)
+		p.GetData()[0] = byte(i + 1)
+		assert.True(t, bpm.UnpinPage(i, true))
+	}
+	assert.NoError(t, bpm.Close())
+
+	disk, err = NewDiskManager(file)
+	assert.NoError(t, err)
+	s := NewDiskScheduler(disk, 2)
+	defer s.Shutdown()
+	bpm = NewBufferPool(3, disk, WithDiskScheduler(s))
+
+	assert.NoError(t, bpm.Prefetch(1))
+	assert.NoError(t, bpm.Prefetch(2))
+	assert.NoError(t, bpm.Prefetch(1))
+	p, err := bpm.FetchPage(1)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(2), p.GetData()[0])
+	assert.True(t, bpm.UnpinPage(1, false))
+
+	// prefetch pin is released once the read completes
+	assert.Eventually(t, func() bool {
+		return bpm.Stats().PinnedFrames == 0
+	}, time.Second, time.Millisecond)
+	stats := bpm.Stats()
+	assert.Equal(t, uint64(2), stats.DiskReads)
+	assert.Equal(t, uint64(1), stats.FetchHits)
+
+	// a failed prefetch gives its frame back
+	assert.NoError(t, bpm.Prefetch(50))
+	assert.Eventually(t, func() bool {
+		return bpm.Stats().FreeFrames == 1
+	}, time.Second, time.Millisecond)
+	_, err = bpm.FetchPage(50)
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, 1, bpm.Stats().FreeFrames)
+	bpm.AssertNoPinnedPages(t)
+	assert.NoError(t, bpm.Close())
+}
+
+func Test_BPMConcurrentFetchReadsOnce(t *testing.T) {
+	file := testDBFile(t)
+	disk, err := NewDiskManager(file)
+	assert.NoError(t, err)
+	s := NewDiskScheduler(disk, 2)
+	defer s.Shutdown()
+	bpm := NewBufferPool(2, disk, WithDiskScheduler(s))
+	p, err := bpm.NewPage()
+	assert.NoError(t, err)
+	p.GetData()[0] = 42
+	assert.True(t, bpm.UnpinPage(0, true))
+	assert.NoError(t, bpm.FlushPage(0))
+	// evict page 0
+	for i := 0; i < 2; i++ {
+		p, err := bpm.NewPage()
+		assert.NoError(t, err)
+		assert.True(t, bpm.UnpinPage(p.GetPageID(), false))
+	}
+	readsBefore := bpm.Stats().DiskReads
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			page, err := bpm.FetchPage(0)
+			if assert.NoError(t, err) {
+				assert.Equal(t, byte(42), page.GetData()[0])
+				assert.True(t, bpm.UnpinPage(0, false))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, readsBefore+1, bpm.Stats().DiskReads)
+	assert.NoError(t, bpm.Close())
+}
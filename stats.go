@@ -0,0 +1,115 @@
+package buff
+
+import (
+	"sync/atomic"
+)
+
+// Stats is a point in time snapshot of buffer pool counters
+type Stats struct {
+	FetchHits   uint64
+	FetchMisses uint64
+	// victims taken from the replacer
+	Evictions uint64
+	// dirty pages written back, either on eviction or by FlushPage
+	DirtyFlushes uint64
+	// pages written back by the background flusher
+	BackgroundFlushes uint64
+	DiskReads         uint64
+	DiskWrites        uint64
+	// frames with non zero pin count
+	PinnedFrames int
+	FreeFrames   int
+}
+
+// HitRate returns fraction of FetchPage calls served from the buffer
+func (s Stats) HitRate() float64 {
+	total := s.FetchHits + s.FetchMisses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.FetchHits) / float64(total)
+}
+
+func (s Stats) add(o Stats) Stats {
+	s.FetchHits += o.FetchHits
+	s.FetchMisses += o.FetchMisses
+	s.Evictions += o.Evictions
+	s.DirtyFlushes += o.DirtyFlushes
+	s.BackgroundFlushes += o.BackgroundFlushes
+	s.DiskReads += o.DiskReads
+	s.DiskWrites += o.DiskWrites
+	s.PinnedFrames += o.PinnedFrames
+	s.FreeFrames += o.FreeFrames
+	return s
+}
+
+// counters are updated atomically, some of them outside of the pool latch
+type counters struct {
+	fetchHits         uint64
+	fetchMisses       uint64
+	evictions         uint64
+	dirtyFlushes      uint64
+	backgroundFlushes uint64
+	diskReads         uint64
+	diskWrites        uint64
+}
+
+func incr(c *uint64) {
+	atomic.AddUint64(c, 1)
+}
+
+// FrameInfo describes the state of one frame of the pool
+type FrameInfo struct {
+	FrameID  int
+	PageID   int
+	PinCount int
+	Dirty    bool
+}
+
+func (b *BufferPool) Stats() Stats {
+	s := Stats{
+		FetchHits:         atomic.LoadUint64(&b.counters.fetchHits),
+		FetchMisses:       atomic.LoadUint64(&b.counters.fetchMisses),
+		Evictions:         atomic.LoadUint64(&b.counters.evictions),
+		DirtyFlushes:      atomic.LoadUint64(&b.counters.dirtyFlushes),
+		BackgroundFlushes: atomic.LoadUint64(&b.counters.backgroundFlushes),
+		DiskReads:         atomic.LoadUint64(&b.counters.diskReads),
+		DiskWrites:        atomic.LoadUint64(&b.counters.diskWrites),
+	}
+	locked(b.mu, func() {
+		for _, page := range b.pageTable {
+			if page.pinCount > 0 {
+				s.PinnedFrames++
+			}
+		}
+		s.FreeFrames = b.freeList.Len()
+	})
+	return s
+}
+
+// Frames dumps every frame ordered by frame id, frames holding
+// no page have PageID -1
+func (b *BufferPool) Frames() []FrameInfo {
+	var ret []FrameInfo
+	locked(b.mu, func() {
+		ret = make([]FrameInfo, 0, len(b.pages))
+		for _, page := range b.pages {
+			ret = append(ret, FrameInfo{
+				FrameID:  page.frameID,
+				PageID:   page.pageID,
+				PinCount: page.pinCount,
+				Dirty:    page.dirty,
+			})
+		}
+	})
+	return ret
+}
+
+// Stats sums up the counters of every instance
+func (p *ParallelBufferPool) Stats() Stats {
+	var s Stats
+	for _, ins := range p.instances {
+		s = s.add(ins.Stats())
+	}
+	return s
+}
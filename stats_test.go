@@ -0,0 +1,50 @@
+package buff
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_BPMStats(t *testing.T) {
+	disk, err := NewDiskManager(testDBFile(t))
+	assert.NoError(t, err)
+	bpm := NewBufferPool(2, disk)
+
+	for i := 0; i < 2; i++ {
+		_, err := bpm.NewPage()
+		assert.NoError(t, err)
+	}
+	assert.True(t, bpm.UnpinPage(0, true))
+
+	// hit on a resident page
+	_, err = bpm.FetchPage(1)
+	assert.NoError(t, err)
+	// new page evicts dirty page 0
+	_, err = bpm.NewPage()
+	assert.NoError(t, err)
+	assert.True(t, bpm.UnpinPage(2, false))
+	// miss on page 0, evicts clean page 2
+	_, err = bpm.FetchPage(0)
+	assert.NoError(t, err)
+	assert.NoError(t, bpm.FlushPage(0))
+	assert.NoError(t, bpm.FlushPage(0))
+
+	s := bpm.Stats()
+	assert.Equal(t, Stats{
+		FetchHits:    1,
+		FetchMisses:  1,
+		Evictions:    2,
+		DirtyFlushes: 1,
+		DiskReads:    1,
+		DiskWrites:   3,
+		PinnedFrames: 2,
+		FreeFrames:   0,
+	}, s)
+	assert.Equal(t, 0.5, s.HitRate())
+
+	assert.Equal(t, []FrameInfo{
+		{FrameID: 0, PageID: 1, PinCount: 2},
+		{FrameID: 1, PageID: 0, PinCount: 1},
+	}, bpm.Frames())
+}